@@ -0,0 +1,46 @@
+// Package bloomotel traces bloomdb loads with OpenTelemetry.
+package bloomotel
+
+import (
+	"context"
+	"github.com/gocodo/bloomdb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+// Tracer implements bloomdb.Tracer with spans from an OpenTelemetry
+// TracerProvider, named "bloomdb." followed by the phase, with spaces
+// replaced by underscores, and carrying the
+// table name and row counts as attributes.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer whose spans come from tp.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer("github.com/gocodo/bloomdb")}
+}
+
+func (t *Tracer) StartPhase(ctx context.Context, table string, phase string) (context.Context, bloomdb.PhaseSpan) {
+	ctx, span := t.tracer.Start(ctx, "bloomdb."+strings.ReplaceAll(phase, " ", "_"),
+		trace.WithAttributes(attribute.String("db.sql.table", table)))
+	return ctx, phaseSpan{span}
+}
+
+type phaseSpan struct {
+	span trace.Span
+}
+
+func (s phaseSpan) SetCount(name string, n int64) {
+	s.span.SetAttributes(attribute.Int64("bloomdb."+name, n))
+}
+
+func (s phaseSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
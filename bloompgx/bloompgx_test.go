@@ -0,0 +1,76 @@
+package bloompgx_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gocodo/bloomdb"
+	"github.com/gocodo/bloomdb/bloompgx"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// benchRows is how many rows each benchmarked load copies.
+const benchRows = 1000000
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+
+// BenchmarkUpsertPq and BenchmarkUpsertPgx compare the two drivers on the
+// same load. They run against the Postgres database at BLOOMDB_TEST_DSN, a
+// URL both drivers accept, e.g.
+//
+//	BLOOMDB_TEST_DSN=postgres://localhost/bloomdb_test?sslmode=disable go test -bench . ./bloompgx
+func BenchmarkUpsertPq(b *testing.B) {
+	benchmarkUpsert(b, "postgres")
+}
+
+func BenchmarkUpsertPgx(b *testing.B) {
+	benchmarkUpsert(b, "pgx", bloomdb.WithDialect(bloompgx.Dialect{}))
+}
+
+func benchmarkUpsert(b *testing.B, driver string, opts ...bloomdb.Option) {
+	dsn := os.Getenv("BLOOMDB_TEST_DSN")
+	if dsn == "" {
+		b.Skip("BLOOMDB_TEST_DSN isn't set")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS bloompgx_bench",
+		"CREATE TABLE bloompgx_bench (id bigint PRIMARY KEY, name text, amount numeric)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer db.Exec("DROP TABLE IF EXISTS bloompgx_bench")
+
+	opts = append(opts, bloomdb.WithLogger(discardLogger{}))
+	columns := []string{"id", "name", "amount"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rows := make(chan []string, 1000)
+		go func() {
+			defer close(rows)
+			for j := 0; j < benchRows; j++ {
+				rows <- []string{strconv.Itoa(j), "name " + strconv.Itoa(j), strconv.Itoa(j%1000) + ".25"}
+			}
+		}()
+
+		stats, err := bloomdb.UpsertContext(context.Background(), db, "bloompgx_bench", []string{"id"}, columns, rows, opts...)
+		if err != nil {
+			for range rows {
+			}
+			b.Fatal(err)
+		}
+		if stats.RowsCopied != benchRows {
+			b.Fatalf("copied %d rows, want %d", stats.RowsCopied, benchRows)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package bloomprom exports bloomdb load metrics to Prometheus.
+package bloomprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Observer implements bloomdb.MetricsObserver with Prometheus counters and a
+// histogram, each labelled by table.
+type Observer struct {
+	rowsCopied *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	errors     *prometheus.CounterVec
+}
+
+// NewObserver creates an Observer and registers its metrics with reg.
+func NewObserver(reg prometheus.Registerer) (*Observer, error) {
+	o := &Observer{
+		rowsCopied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bloomdb",
+			Name:      "rows_copied_total",
+			Help:      "Rows copied into temp tables.",
+		}, []string{"table"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "bloomdb",
+			Name:      "load_duration_seconds",
+			Help:      "Duration of successful loads.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"table"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bloomdb",
+			Name:      "load_errors_total",
+			Help:      "Loads that failed.",
+		}, []string{"table"}),
+	}
+
+	for _, c := range []prometheus.Collector{o.rowsCopied, o.duration, o.errors} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+func (o *Observer) ObserveRowsCopied(table string, n int) {
+	o.rowsCopied.WithLabelValues(table).Add(float64(n))
+}
+
+func (o *Observer) ObserveDuration(table string, d time.Duration) {
+	o.duration.WithLabelValues(table).Observe(d.Seconds())
+}
+
+func (o *Observer) ObserveError(table string) {
+	o.errors.WithLabelValues(table).Inc()
+}
@@ -0,0 +1,75 @@
+package bloomdb
+
+import (
+	"context"
+	"errors"
+)
+
+// Builder configures a load step by step, as an alternative to passing
+// UpsertContext a long list of options:
+//
+//	stats, err := bloomdb.New(db).Table("claims").IDColumn("id").
+//		Columns(columns).WithRevisions().DeleteMissing().Run(ctx, rows)
+//
+// Each method returns the Builder, and Run loads with everything gathered.
+// Options without a method of their own are added with With.
+type Builder struct {
+	db        DB
+	table     string
+	idColumns []string
+	columns   []string
+	opts      []Option
+}
+
+// New starts a Builder for a load into db.
+func New(db DB) *Builder {
+	return &Builder{db: db}
+}
+
+// Table sets the table to load into.
+func (b *Builder) Table(table string) *Builder {
+	b.table = table
+	return b
+}
+
+// IDColumn adds a column of the table's unique key; call it once per column
+// for a composite key.
+func (b *Builder) IDColumn(column string) *Builder {
+	b.idColumns = append(b.idColumns, column)
+	return b
+}
+
+// Columns sets the columns named by the values of each row.
+func (b *Builder) Columns(columns []string) *Builder {
+	b.columns = columns
+	return b
+}
+
+// WithRevisions adds the WithRevisions option.
+func (b *Builder) WithRevisions() *Builder {
+	return b.With(WithRevisions())
+}
+
+// DeleteMissing adds the WithDeleteMissing option, deleting the rows of the
+// table that are missing from the input.
+func (b *Builder) DeleteMissing() *Builder {
+	return b.With(WithDeleteMissing())
+}
+
+// With adds opts to the load.
+func (b *Builder) With(opts ...Option) *Builder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Run loads rows like UpsertContext. It fails before touching the database
+// if the table or the columns weren't set.
+func (b *Builder) Run(ctx context.Context, rows chan []string) (UpsertStats, error) {
+	if b.table == "" {
+		return UpsertStats{}, errors.New("bloomdb: the builder needs a Table")
+	}
+	if len(b.columns) == 0 {
+		return UpsertStats{}, errors.New("bloomdb: the builder needs Columns")
+	}
+	return UpsertContext(ctx, b.db, b.table, b.idColumns, b.columns, rows, b.opts...)
+}
@@ -0,0 +1,267 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DetectColumns returns the columns of table that a load can write to, in
+// table order. Generated columns and identity columns declared GENERATED
+// ALWAYS are left out, since they can't be inserted into.
+//
+// The load functions call it themselves when they're given no columns. An
+// explicit column list always wins and is used as it is, e.g. to load only
+// some of the columns.
+func DetectColumns(ctx context.Context, db DB, table string, opts ...Option) ([]string, error) {
+	columns, _, err := detectColumns(ctx, db, table, newOptions(opts))
+	return columns, err
+}
+
+// detectColumns is DetectColumns, also returning the data type of each
+// column.
+func detectColumns(ctx context.Context, db querier, table string, opts *options) ([]string, map[string]string, error) {
+	query, args := opts.dialect.ColumnsQuery(table)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns := []string{}
+	types := map[string]string{}
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, column)
+		types[column] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf("%w: table %q not found or has no writable columns", ErrNoColumns, table)
+	}
+	return columns, types, nil
+}
+
+// resolveColumns looks up table's columns, checks idColumns and columns
+// against them and returns the id columns and the columns to load, which are
+// all of table's if columns is empty. With WithCaseInsensitiveColumns they're
+// returned as the table spells them. It also tells opts the loaded columns'
+// types.
+func resolveColumns(ctx context.Context, db querier, table string, idColumns []string, columns []string, opts *options) ([]string, []string, error) {
+	tableColumns, types, err := detectColumns(ctx, db, table, opts)
+	if err != nil {
+		return nil, nil, phaseError(table, "detect columns", err)
+	}
+	if len(columns) == 0 {
+		columns = tableColumns
+	}
+	if opts.caseInsensitiveColumns {
+		idColumns, err = matchColumnCase(table, tableColumns, idColumns)
+		if err != nil {
+			return nil, nil, err
+		}
+		columns, err = matchColumnCase(table, tableColumns, columns)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = checkColumns(table, tableColumns, idColumns, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = addPartitionKey(ctx, db, table, idColumns, opts)
+	if err != nil {
+		return nil, nil, phaseError(table, "detect columns", err)
+	}
+	if len(opts.conflictColumns) > 0 || len(opts.partitionKey) > 0 {
+		err = checkUniqueKey(ctx, db, table, opts.conflictKey(idColumns), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for column, dataType := range opts.columnTypes {
+		types[column] = dataType
+	}
+	err = checkMergeStrategies(table, types, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.setColumnTypes(columns, types)
+	return idColumns, columns, nil
+}
+
+// matchColumnCase returns names with each one spelled like the column of
+// tableColumns it matches ignoring case. An exact match always wins; a name
+// matching several columns that differ only in case is an error. Names that
+// match nothing are kept for checkColumns to report.
+func matchColumnCase(table string, tableColumns []string, names []string) ([]string, error) {
+	matched := make([]string, len(names))
+	for i, name := range names {
+		matched[i] = name
+		if contains(tableColumns, name) {
+			continue
+		}
+		found := ""
+		for _, column := range tableColumns {
+			if !strings.EqualFold(column, name) {
+				continue
+			}
+			if found != "" {
+				return nil, fmt.Errorf("%w: column %q matches both %q and %q of table %q", ErrColumnMismatch, name, found, column, table)
+			}
+			found = column
+		}
+		if found != "" {
+			matched[i] = found
+		}
+	}
+	return matched, nil
+}
+
+// checkMergeStrategies makes sure each column with a merge strategy has a
+// type the strategy can merge.
+func checkMergeStrategies(table string, types map[string]string, opts *options) error {
+	for column, strategy := range opts.mergeStrategies {
+		dataType := strings.ToLower(types[column])
+		isArray := dataType == "array" || strings.HasSuffix(dataType, "[]")
+		switch {
+		case strategy == JSONBMerge && dataType != "jsonb":
+			return fmt.Errorf("%w: column %q of table %q is %s, but JSONBMerge needs jsonb", ErrColumnMismatch, column, table, dataType)
+		case (strategy == ArrayAppend || strategy == ArrayUnion) && !isArray:
+			return fmt.Errorf("%w: column %q of table %q is %s, but array merge strategies need an array", ErrColumnMismatch, column, table, dataType)
+		}
+	}
+	return nil
+}
+
+// checkColumns makes sure every key and loaded column is one of the table's
+// columns, so a typo fails before anything is copied rather than deep inside
+// the bulk load. Columns DetectColumns leaves out count as missing, since
+// they can't be loaded either.
+func checkColumns(table string, tableColumns []string, idColumns []string, columns []string) error {
+	for _, column := range idColumns {
+		if !contains(tableColumns, column) {
+			return fmt.Errorf("%w: id column %q not found on table %q", ErrColumnMismatch, column, table)
+		}
+	}
+	for _, column := range columns {
+		if !contains(tableColumns, column) {
+			return fmt.Errorf("%w: column %q not found on table %q", ErrColumnMismatch, column, table)
+		}
+	}
+	return nil
+}
+
+// querier is the part of *sql.DB, *sql.Conn and *sql.Tx used to look up a
+// table's columns.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// addPartitionKey adds the partition key columns of a partitioned table to
+// the conflict columns, as Postgres needs every unique index of a
+// partitioned table to include them. The table then needs a unique index
+// over the conflict columns together with its partition key. The key is
+// kept apart from WithConflictColumns' columns, so running it again with
+// the same opts, as a replayed load does, finds the same key.
+func addPartitionKey(ctx context.Context, db querier, table string, idColumns []string, opts *options) error {
+	opts.partitionKey = nil
+	query, args := opts.dialect.PartitionKeyQuery(table)
+	if query == "" || len(opts.conflictKey(idColumns)) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	conflictColumns := opts.conflictKey(idColumns)
+	var partitionKey []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		if !contains(conflictColumns, column) {
+			partitionKey = append(partitionKey, column)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(partitionKey) > 0 {
+		opts.partitionKey = partitionKey
+		opts.logger.Printf("Table %s is partitioned, matching rows on %v", table, opts.conflictKey(idColumns))
+	}
+	return nil
+}
+
+// checkUniqueKey makes sure table has a unique index over the conflict
+// columns key, which ON CONFLICT needs.
+func checkUniqueKey(ctx context.Context, db querier, table string, key []string, opts *options) error {
+	query, args := opts.dialect.UniqueKeyQuery(table, key)
+	var unique bool
+	err := db.QueryRowContext(ctx, query, args...).Scan(&unique)
+	if err != nil {
+		return phaseError(table, "detect columns", err)
+	}
+	if !unique {
+		return fmt.Errorf("%w: conflict columns %v aren't a unique key of table %q", ErrColumnMismatch, key, table)
+	}
+	return nil
+}
+
+// viewError replaces err, from a phase of a load into table that fails when
+// table is a view, with one saying so if it is. Any other err, or one that
+// can't be checked, is returned as it is.
+func viewError(ctx context.Context, db querier, table string, opts *options, err error) error {
+	var upsertErr *UpsertError
+	if !errors.As(err, &upsertErr) || ctx.Err() != nil {
+		return err
+	}
+	switch upsertErr.Phase {
+	case "create temp table", "revisions", "upsert":
+	default:
+		return err
+	}
+
+	view := viewName(ctx, db, table, opts)
+	if view == "" {
+		return err
+	}
+	return phaseError(table, upsertErr.Phase, fmt.Errorf("bloomdb: %s is a view, not a table: %w", view, upsertErr.Err))
+}
+
+// viewName returns table's schema-qualified name if it's a view, or "" if
+// it isn't or that can't be looked up.
+func viewName(ctx context.Context, db querier, table string, opts *options) string {
+	query, args := opts.dialect.TableTypeQuery(table)
+	var schema, tableType string
+	if db.QueryRowContext(ctx, query, args...).Scan(&schema, &tableType) != nil || tableType != "VIEW" {
+		return ""
+	}
+	_, name := splitTable(table)
+	return schema + "." + name
+}
+
+// splitTable splits a possibly schema-qualified table name. schema is empty
+// if table isn't qualified.
+func splitTable(table string) (schema string, name string) {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return "", table
+}
@@ -0,0 +1,115 @@
+package bloomdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchColumnCase(t *testing.T) {
+	tests := []struct {
+		name         string
+		tableColumns []string
+		names        []string
+		want         []string
+		wantErr      string
+	}{
+		{
+			name:         "mixed case header",
+			tableColumns: []string{"patientid", "amount"},
+			names:        []string{"PatientID", "Amount"},
+			want:         []string{"patientid", "amount"},
+		},
+		{
+			name:         "exact match wins",
+			tableColumns: []string{"Amount", "amount"},
+			names:        []string{"amount"},
+			want:         []string{"amount"},
+		},
+		{
+			name:         "no match is kept",
+			tableColumns: []string{"id"},
+			names:        []string{"Total"},
+			want:         []string{"Total"},
+		},
+		{
+			name:         "ambiguous",
+			tableColumns: []string{"id", "Amount", "amount"},
+			names:        []string{"AMOUNT"},
+			wantErr:      `column "AMOUNT" matches both "Amount" and "amount"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := matchColumnCase("claims", test.tableColumns, test.names)
+			if test.wantErr != "" {
+				if !errors.Is(err, ErrColumnMismatch) || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got %v, want ErrColumnMismatch saying %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpsertCaseInsensitiveColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		opts    []Option
+		wantErr string
+	}{
+		{"matched", []string{"id", "amount"}, []Option{WithCaseInsensitiveColumns()}, ""},
+		{"case sensitive", []string{"id", "amount"}, nil, `id column "ID" not found`},
+		{"ambiguous", []string{"id", "Amount", "amount"}, []Option{WithCaseInsensitiveColumns()}, "matches both"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, test.columns...)
+			opts := append([]Option{WithLogger(discardLogger{}), WithSmallBatchThreshold(0)}, test.opts...)
+			_, err := UpsertCSV(context.Background(), f.db, "claims", []string{"ID"}, nil, strings.NewReader("ID,AMOUNT\n1,10\n"), opts...)
+			if test.wantErr != "" {
+				if !errors.Is(err, ErrColumnMismatch) || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got %v, want ErrColumnMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The SQL spells the columns like the table.
+			if f.ran(`COPY "`) != 1 || !strings.Contains(f.statements[f.index(`COPY "`)], `("id", "amount")`) {
+				t.Errorf("ran %q, want the table's spelling of the columns", f.statements)
+			}
+		})
+	}
+}
+
+func TestAddPartitionKeyTwice(t *testing.T) {
+	f := newFakeDB(t, "id", "created", "amount")
+	f.partitionKey = []string{"created"}
+	opts := newOptions([]Option{WithLogger(discardLogger{}), WithConflictColumns("id")})
+
+	// A replayed load resolves its columns again with the same options.
+	for i := 0; i < 2; i++ {
+		if err := addPartitionKey(context.Background(), f.db, "claims", []string{"id"}, opts); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := opts.conflictKey([]string{"id"}), []string{"id", "created"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d: got conflict key %q, want %q", i+1, got, want)
+		}
+	}
+	if want := []string{"id"}; !reflect.DeepEqual(opts.conflictColumns, want) {
+		t.Errorf("got conflict columns %q, want them left as %q", opts.conflictColumns, want)
+	}
+}
@@ -0,0 +1,417 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// copyRows creates the temp table and copies rows into it. All rows go
+// through a single bulk load in one transaction unless opts.copyBatchSize is
+// set, or WithRejectedRows is given, in which case the load is committed and
+// restarted every batch. Errors are returned with the phase that failed.
+func copyRows(ctx context.Context, conn DB, st Statements, table string, columns []string, rows rowSource, opts *options, stats *UpsertStats) error {
+	counter := copyCounter{ctx: ctx, table: table, opts: opts, stats: stats}
+	defer counter.done()
+
+	w := copyWriter{conn: conn, table: table, tempTable: st.TempTable, columns: columns, opts: opts,
+		setup: st.CreateTempTable, rejected: &stats.RowsRejected}
+	// Rolling back a committed transaction just returns sql.ErrTxDone.
+	defer w.rollback()
+
+	err := w.begin(ctx)
+	if err != nil {
+		return createTempTableError(table, opts, err)
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return phaseError(table, "copy", err)
+		}
+		row, ok, err := rows(ctx)
+		if err != nil {
+			return phaseError(table, "copy", err)
+		}
+		if !ok {
+			break
+		}
+
+		opts.convertNulls(row)
+		err = w.write(ctx, inputRow{values: row, line: opts.line()})
+		if err != nil {
+			return phaseError(table, "copy", err)
+		}
+		counter.count()
+	}
+
+	err = w.finish(ctx)
+	if err != nil {
+		return phaseError(table, "copy", err)
+	}
+	return nil
+}
+
+// copyRowsParallel is copyRows for WithParallelism above 1. Rows are read on
+// the calling goroutine and handed to the workers, each copying into the
+// shared staging table over its own connection from db.
+func copyRowsParallel(ctx context.Context, db DB, conn DB, st Statements, table string, columns []string, rows rowSource, opts *options, stats *UpsertStats) error {
+	pool, ok := db.(connector)
+	if !ok {
+		return phaseError(table, "connect", errors.New("bloomdb: parallel loads need a DB with a Conn method, such as *sql.DB"))
+	}
+
+	err := execTx(ctx, conn, st.CreateTempTable, opts)
+	if err != nil {
+		return createTempTableError(table, opts, err)
+	}
+	var rejected int64
+	defer func() {
+		stats.RowsRejected = rejected
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan inputRow, opts.parallelism)
+	errs := make(chan error, opts.parallelism)
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := copyWorker(ctx, pool, st, table, columns, work, opts, &rejected)
+			if err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+
+	err = dispatchRows(ctx, rows, work, table, opts, stats)
+	close(work)
+	wg.Wait()
+
+	// A failing worker cancels ctx, so prefer its error over the
+	// cancellation it caused.
+	select {
+	case err = <-errs:
+	default:
+	}
+	if err != nil {
+		return phaseError(table, "copy", err)
+	}
+	return nil
+}
+
+// dispatchRows reads every row and sends it to the copy workers.
+func dispatchRows(ctx context.Context, rows rowSource, work chan<- inputRow, table string, opts *options, stats *UpsertStats) error {
+	counter := copyCounter{ctx: ctx, table: table, opts: opts, stats: stats}
+	defer counter.done()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		row, ok, err := rows(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		opts.convertNulls(row)
+		select {
+		case work <- inputRow{values: row, line: opts.line()}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		counter.count()
+	}
+}
+
+func copyWorker(ctx context.Context, db connector, st Statements, table string, columns []string, work <-chan inputRow, opts *options, rejected *int64) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := copyWriter{conn: conn, table: table, tempTable: st.TempTable, columns: columns, opts: opts,
+		rejected: rejected}
+	defer w.rollback()
+
+	err = w.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	for row := range work {
+		err = w.write(ctx, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return w.finish(ctx)
+}
+
+// inputRow is a row to copy, with the line of the input it started on, or 0
+// if the input has no lines.
+type inputRow struct {
+	values []interface{}
+	line   int
+}
+
+// rejectBatchSize is how many rows are committed at a time with
+// WithRejectedRows if WithCopyBatchSize isn't given, since each batch is
+// held in memory in case it has to be replayed.
+const rejectBatchSize = 10000
+
+// copyWriter bulk loads rows into the temp table over one connection,
+// committing and starting over every opts.copyBatchSize rows if that's set.
+type copyWriter struct {
+	conn      DB
+	table     string
+	tempTable string
+	columns   []string
+	opts      *options
+	// setup runs at the start of the first transaction, until one commits.
+	setup string
+	// rejected counts the rows sent to opts.rejectedRows, and may be shared
+	// with other writers.
+	rejected *int64
+
+	txn       *sql.Tx
+	loader    BulkLoader
+	rows      int
+	committed bool
+	// batch holds the rows of the open transaction with WithRejectedRows.
+	batch []inputRow
+}
+
+// begin starts a transaction and a bulk load in it.
+func (w *copyWriter) begin(ctx context.Context) error {
+	err := w.beginTxn(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.loader, err = bulkLoad(ctx, w.opts.dialect, w.conn, w.txn, w.tempTable, w.columns)
+	return err
+}
+
+// beginTxn starts a transaction, running setup in it until one commits.
+func (w *copyWriter) beginTxn(ctx context.Context) error {
+	txn, err := beginTx(ctx, w.conn, w.opts)
+	if err != nil {
+		return err
+	}
+	w.txn = txn
+
+	if w.setup != "" && !w.committed {
+		_, err = txn.ExecContext(ctx, w.setup)
+	}
+	return err
+}
+
+func (w *copyWriter) batchSize() int {
+	if w.opts.copyBatchSize == 0 && w.opts.rejectedRows != nil {
+		return rejectBatchSize
+	}
+	return w.opts.copyBatchSize
+}
+
+func (w *copyWriter) write(ctx context.Context, row inputRow) error {
+	if w.opts.rejectedRows != nil {
+		w.batch = append(w.batch, row)
+	}
+
+	err := w.loader.WriteRow(ctx, row.values)
+	if err != nil {
+		if w.canReplay(ctx) {
+			err = w.replay(ctx, err)
+			if err != nil {
+				return err
+			}
+			return w.begin(ctx)
+		}
+		if row.line > 0 {
+			w.opts.logger.Printf("Failed to copy row from line %d into table %s: %v", row.line, w.table, row.values)
+			return fmt.Errorf("line %d: %w", row.line, err)
+		}
+		w.opts.logger.Printf("Failed to copy row into table %s: %v", w.table, row.values)
+		return err
+	}
+
+	w.rows++
+	if batchSize := w.batchSize(); batchSize > 0 && w.rows%batchSize == 0 {
+		err = w.finish(ctx)
+		if err != nil {
+			return err
+		}
+		return w.begin(ctx)
+	}
+	if flushEvery := w.opts.flushEvery; flushEvery > 0 && w.rows%flushEvery == 0 {
+		return w.flush(ctx)
+	}
+
+	return nil
+}
+
+// flush ends the bulk load and starts another in the same transaction.
+func (w *copyWriter) flush(ctx context.Context) error {
+	err := w.loader.Close(ctx)
+	if err != nil {
+		if w.canReplay(ctx) {
+			err = w.replay(ctx, err)
+			if err != nil {
+				return err
+			}
+			return w.begin(ctx)
+		}
+		return err
+	}
+
+	w.loader, err = bulkLoad(ctx, w.opts.dialect, w.conn, w.txn, w.tempTable, w.columns)
+	return err
+}
+
+// finish flushes the rows buffered by the bulk load and commits them.
+func (w *copyWriter) finish(ctx context.Context) error {
+	err := w.loader.Close(ctx)
+	if err == nil {
+		err = w.txn.Commit()
+	}
+	if err != nil {
+		if w.canReplay(ctx) {
+			return w.replay(ctx, err)
+		}
+		return err
+	}
+
+	w.committed = true
+	w.batch = nil
+	return nil
+}
+
+// canReplay reports whether a failed batch should be replayed to find the
+// rows to reject, rather than failing the load.
+func (w *copyWriter) canReplay(ctx context.Context) bool {
+	return w.opts.rejectedRows != nil && ctx.Err() == nil
+}
+
+// replay redoes the open transaction, which failed with err, after rolling it
+// back. The bulk load can't carry on past a bad row, so each row of the batch
+// is loaded on its own behind a savepoint, and the ones that fail are sent to
+// opts.rejectedRows.
+func (w *copyWriter) replay(ctx context.Context, err error) error {
+	w.opts.logger.Printf("Copy into table %s failed, retrying %d rows one at a time: %v", w.table, len(w.batch), err)
+	w.txn.Rollback()
+
+	batch := w.batch
+	w.batch = nil
+	err = w.beginTxn(ctx)
+	if err != nil {
+		return err
+	}
+	txn := w.txn
+
+	for _, row := range batch {
+		_, err = txn.ExecContext(ctx, "SAVEPOINT bloomdb_row")
+		if err != nil {
+			return err
+		}
+		rowErr := w.loadRow(ctx, row.values)
+		if rowErr == nil {
+			_, err = txn.ExecContext(ctx, "RELEASE SAVEPOINT bloomdb_row")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = txn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bloomdb_row")
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(w.rejected, 1)
+		select {
+		case w.opts.rejectedRows <- RejectedRow{Row: row.values, Line: row.line, Err: rowErr}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// loadRow bulk loads a single row in the open transaction.
+func (w *copyWriter) loadRow(ctx context.Context, row []interface{}) error {
+	loader, err := bulkLoad(ctx, w.opts.dialect, w.conn, w.txn, w.tempTable, w.columns)
+	if err != nil {
+		return err
+	}
+	err = loader.WriteRow(ctx, row)
+	if err != nil {
+		loader.Close(ctx)
+		return err
+	}
+	return loader.Close(ctx)
+}
+
+func (w *copyWriter) rollback() {
+	if w.txn != nil {
+		w.txn.Rollback()
+	}
+}
+
+// copyCounter does the bookkeeping for each row copied: the running count,
+// progress logging and callbacks, and metrics.
+type copyCounter struct {
+	ctx   context.Context
+	table string
+	opts  *options
+	stats *UpsertStats
+
+	// Rows are reported to opts.metrics in chunks rather than one at a time.
+	reported int
+}
+
+func (c *copyCounter) count() {
+	c.stats.RowsCopied++
+
+	if c.opts.logEvery > 0 && c.stats.RowsCopied%c.opts.logEvery == 0 {
+		c.opts.logger.Printf("Processed %d rows...", c.stats.RowsCopied)
+	}
+	if c.stats.RowsCopied%c.opts.progressInterval == 0 {
+		if c.opts.progressFunc != nil {
+			c.opts.progressFunc(c.stats.RowsCopied)
+		}
+		c.opts.sendEvent(c.ctx, EventCopyProgress, c.table, c.stats)
+		c.report()
+	}
+}
+
+// done reports any rows not yet passed on to opts.metrics.
+func (c *copyCounter) done() {
+	c.report()
+}
+
+func (c *copyCounter) report() {
+	if c.opts.metrics != nil && c.stats.RowsCopied > c.reported {
+		c.opts.metrics.ObserveRowsCopied(c.table, c.stats.RowsCopied-c.reported)
+		c.reported = c.stats.RowsCopied
+	}
+}
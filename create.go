@@ -0,0 +1,60 @@
+package bloomdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// createTableSQL returns the statement creating table, if it doesn't exist
+// yet, for WithCreateTable. The loaded columns come first, in order,
+// followed by any other columns in opts.createTable by name, and the key
+// columns make up the primary key.
+func createTableSQL(table string, keyColumns []string, columns []string, opts *options) (string, error) {
+	if len(columns) == 0 {
+		return "", errors.New("bloomdb: creating a missing table needs the columns to be given")
+	}
+	for _, column := range append(append([]string{}, keyColumns...), columns...) {
+		if opts.createTable[column] == "" {
+			return "", fmt.Errorf("%w: column %q has no type to create table %q with", ErrColumnMismatch, column, table)
+		}
+	}
+
+	extra := []string{}
+	for column := range opts.createTable {
+		if !contains(columns, column) {
+			extra = append(extra, column)
+		}
+	}
+	sort.Strings(extra)
+
+	quote := opts.dialect.QuoteIdentifier
+	definitions := []string{}
+	for _, column := range append(append([]string{}, columns...), extra...) {
+		definitions = append(definitions, quote(column)+" "+opts.createTable[column])
+	}
+	if len(keyColumns) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+strings.Join(quoteAll(quote, keyColumns), ", ")+")")
+	}
+
+	return "CREATE TABLE IF NOT EXISTS " + quoteQualified(quote, table) + " (" + strings.Join(definitions, ", ") + ")", nil
+}
+
+// createTable creates table with WithCreateTable's column types if it
+// doesn't exist yet.
+func createTable(ctx context.Context, db execQuerier, table string, idColumns []string, columns []string, opts *options) error {
+	if opts.createTable == nil {
+		return nil
+	}
+	query, err := createTableSQL(table, opts.conflictKey(idColumns), columns, opts)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, query)
+	if err != nil {
+		return phaseError(table, "create table", err)
+	}
+	return nil
+}
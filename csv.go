@@ -0,0 +1,188 @@
+package bloomdb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UpsertCSV is like UpsertContext, but streams its rows from CSV data in r.
+// If columns is empty, the first record is read as a header naming the
+// columns, trimmed of spaces, which WithColumnMapping can rename; otherwise
+// every record is data and must have len(columns) fields. A UTF-8 byte order
+// mark at the start of r is skipped, and gzipped data is decompressed as
+// it's read. Records are read one at a time, so the input is never held in
+// memory.
+// Errors about a row, and the rows sent to WithRejectedRows, name the line
+// of r it started on. With WithLoadRetries, an r that is an io.Seeker is
+// read again from where it started if the load is retried.
+func UpsertCSV(ctx context.Context, db DB, table string, idColumns []string, columns []string, r io.Reader, opts ...Option) (UpsertStats, error) {
+	o := newOptions(opts)
+	line := 0
+	o.inputLine = func() int { return line }
+	// The offset is taken before reading, since the buffering reads ahead.
+	seeker, seekable := r.(io.Seeker)
+	seekable = seekable && o.loadRetry.MaxAttempts >= 2
+	start := int64(0)
+	if seekable {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		// An error means it isn't actually seekable, such as a pipe.
+		seekable = err == nil
+	}
+	header, rows, err := openCSV(r, columns, &line)
+	if err != nil {
+		return UpsertStats{}, err
+	}
+	if !seekable {
+		return upsert(ctx, db, table, idColumns, header, rows, o)
+	}
+	return replayUpsert(ctx, db, table, idColumns, header, func(attempt int) (rowSource, error) {
+		if attempt == 1 {
+			return rows, nil
+		}
+		_, err := seeker.Seek(start, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		_, rows, err := openCSV(r, columns, &line)
+		return rows, err
+	}, o)
+}
+
+// openCSV starts reading the CSV data in r, returning the columns named by
+// its header if columns is empty, and columns otherwise. The rows set line to
+// the line each record started on.
+func openCSV(r io.Reader, columns []string, line *int) ([]string, rowSource, error) {
+	r, err := gunzip(r)
+	if err != nil {
+		return nil, nil, csvError(err)
+	}
+	reader := csv.NewReader(skipBOM(r))
+	reader.ReuseRecord = true
+
+	if len(columns) == 0 {
+		header, err := reader.Read()
+		if err != nil {
+			return nil, nil, csvError(err)
+		}
+		columns = make([]string, len(header))
+		for i, name := range header {
+			columns[i] = strings.TrimSpace(name)
+		}
+	} else {
+		reader.FieldsPerRecord = len(columns)
+	}
+	return columns, csvRows(reader, line), nil
+}
+
+// skipBOM drops the byte order mark some tools write at the start of UTF-8
+// files, which would otherwise end up in the first column's name, or break
+// the parsing of a quoted first field.
+func skipBOM(r io.Reader) io.Reader {
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		buffered.Discard(3)
+	}
+	return buffered
+}
+
+// gunzip returns a reader decompressing r if it starts with the gzip magic
+// bytes, or one reading r as is otherwise. Errors in the gzip stream name the
+// byte offset into r they were found at.
+func gunzip(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err != nil || string(magic) != "\x1f\x8b" {
+		return buffered, nil
+	}
+
+	// gzip reads byte by byte from a reader that has ReadByte, so the count
+	// is exactly where in r it got to.
+	counted := &countingReader{r: buffered}
+	gz, err := gzip.NewReader(counted)
+	if err != nil {
+		return nil, gzipError{offset: counted.n, err: err}
+	}
+	return gzipReader{gz: gz, counted: counted}, nil
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+type gzipReader struct {
+	gz      *gzip.Reader
+	counted *countingReader
+}
+
+func (g gzipReader) Read(p []byte) (int, error) {
+	n, err := g.gz.Read(p)
+	if err != nil && err != io.EOF {
+		err = gzipError{offset: g.counted.n, err: err}
+	}
+	return n, err
+}
+
+// gzipError is a truncated or corrupt gzip stream.
+type gzipError struct {
+	offset int64
+	err    error
+}
+
+func (e gzipError) Error() string {
+	return fmt.Sprintf("gzip input is corrupt at byte %d: %v", e.offset, e.err)
+}
+
+func (e gzipError) Unwrap() error {
+	return e.err
+}
+
+func csvRows(reader *csv.Reader, line *int) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			// A *csv.ParseError names its line already.
+			*line = 0
+			return nil, false, csvError(err)
+		}
+		*line, _ = reader.FieldPos(0)
+
+		row := make([]interface{}, len(record))
+		for i, value := range record {
+			row[i] = value
+		}
+		return row, true, nil
+	}
+}
+
+// csvError wraps an error from the CSV reader. A *csv.ParseError already
+// names the line it happened on.
+func csvError(err error) error {
+	if err == io.EOF {
+		return errors.New("bloomdb: CSV input is empty")
+	}
+	return fmt.Errorf("bloomdb: reading CSV input: %w", err)
+}
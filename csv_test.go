@@ -0,0 +1,238 @@
+package bloomdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		columns []string
+		header  []string
+		rows    [][]interface{}
+		lines   []int
+	}{
+		{
+			name:   "header",
+			input:  "id, name\n1,a\n2,b\n",
+			header: []string{"id", "name"},
+			rows:   [][]interface{}{{"1", "a"}, {"2", "b"}},
+			lines:  []int{2, 3},
+		},
+		{
+			name:    "no header",
+			input:   "1,a\n2,b\n",
+			columns: []string{"id", "name"},
+			header:  []string{"id", "name"},
+			rows:    [][]interface{}{{"1", "a"}, {"2", "b"}},
+			lines:   []int{1, 2},
+		},
+		{
+			name:   "byte order mark",
+			input:  "\xef\xbb\xbf\"id\",name\n1,a\n",
+			header: []string{"id", "name"},
+			rows:   [][]interface{}{{"1", "a"}},
+			lines:  []int{2},
+		},
+		{
+			name:   "multiline field",
+			input:  "id,name\n1,\"a\nb\"\n2,c\n",
+			header: []string{"id", "name"},
+			rows:   [][]interface{}{{"1", "a\nb"}, {"2", "c"}},
+			lines:  []int{2, 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := 0
+			header, rows, err := openCSV(strings.NewReader(test.input), test.columns, &line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(header, test.header) {
+				t.Errorf("got header %q, want %q", header, test.header)
+			}
+
+			var got [][]interface{}
+			var lines []int
+			for {
+				row, ok, err := rows(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, row)
+				lines = append(lines, line)
+			}
+			if !reflect.DeepEqual(got, test.rows) {
+				t.Errorf("got rows %q, want %q", got, test.rows)
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("got lines %v, want %v", lines, test.lines)
+			}
+		})
+	}
+}
+
+func TestOpenCSVGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("id,name\n1,a\n"))
+	gz.Close()
+
+	line := 0
+	header, rows, err := openCSV(&buf, nil, &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, ok, err := rows(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v reading a row", ok, err)
+	}
+	if !reflect.DeepEqual(header, []string{"id", "name"}) || !reflect.DeepEqual(row, []interface{}{"1", "a"}) {
+		t.Errorf("got header %q and row %q", header, row)
+	}
+}
+
+func TestOpenCSVErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		columns []string
+		line    int
+		want    string
+	}{
+		{
+			name:  "malformed quoted field",
+			input: "id,name\n1,a\n2,\"b\"c\n",
+			line:  3,
+			want:  "line 3",
+		},
+		{
+			name:    "wrong number of fields",
+			input:   "1,a\n2,b,c\n",
+			columns: []string{"id", "name"},
+			line:    2,
+			want:    "wrong number of fields",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := 0
+			header, rows, err := openCSV(strings.NewReader(test.input), test.columns, &line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := newOptions(nil)
+			opts.inputLine = func() int { return line }
+			_, err = readAll(loadRows(rows, header, opts, &UpsertStats{}))
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("got %v, want a *csv.ParseError", err)
+			}
+			if parseErr.StartLine != test.line {
+				t.Errorf("got the error on line %d, want %d", parseErr.StartLine, test.line)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %q, want it to mention %q", err, test.want)
+			}
+			// The parse error names its line already.
+			if strings.Count(err.Error(), "line ") > 1 {
+				t.Errorf("got %q, which names the line twice", err)
+			}
+		})
+	}
+}
+
+func TestOpenCSVLinesOfRowErrors(t *testing.T) {
+	line := 0
+	header, rows, err := openCSV(strings.NewReader("id,active\n1,Y\n\"2\n\",X\n"), nil, &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := newOptions([]Option{WithConverters(map[string]func(string) (interface{}, error){
+		"active": func(s string) (interface{}, error) {
+			if s != "Y" {
+				return nil, errors.New("not Y")
+			}
+			return true, nil
+		},
+	})})
+	opts.inputLine = func() int { return line }
+	_, err = readAll(loadRows(rows, header, opts, &UpsertStats{}))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Errorf("got %v, want an error from line 3", err)
+	}
+}
+
+func TestOpenCSVEmpty(t *testing.T) {
+	line := 0
+	_, _, err := openCSV(strings.NewReader(""), nil, &line)
+	if err == nil || !strings.Contains(err.Error(), "CSV input is empty") {
+		t.Errorf("got %v, want an empty input error", err)
+	}
+}
+
+func TestUpsertCSVRejectedRowLines(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.badValue = "oops"
+	rejected := make(chan RejectedRow, 10)
+
+	_, err := UpsertCSV(context.Background(), f.db, "claims", []string{"id"}, nil, strings.NewReader("id,amount\n1,10\n2,oops\n3,30\n"),
+		WithLogger(discardLogger{}), WithSmallBatchThreshold(0), WithRejectedRows(rejected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(rejected)
+
+	var lines []int
+	for row := range rejected {
+		lines = append(lines, row.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{3}) {
+		t.Errorf("got rejected rows from lines %v, want 3", lines)
+	}
+}
+
+func TestUpsertCSVParseError(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	_, err := UpsertCSV(context.Background(), f.db, "claims", []string{"id"}, nil, strings.NewReader("id,amount\n1,10\n2,\"20\"0\n"),
+		WithLogger(discardLogger{}))
+	var parseErr *csv.ParseError
+	if !errors.As(err, &parseErr) || parseErr.StartLine != 3 {
+		t.Errorf("got %v, want a parse error on line 3", err)
+	}
+}
+
+func TestUpsertCSVLineOfBufferedRow(t *testing.T) {
+	// The first rows are read ahead to see whether the input is small, and
+	// then replayed into the copy once it turns out not to be.
+	var b strings.Builder
+	b.WriteString("id,amount\n")
+	for i, row := range numberedRows(1500) {
+		if i == 4 {
+			row[1] = "oops"
+		}
+		b.WriteString(row[0] + "," + row[1] + "\n")
+	}
+
+	f := newFakeDB(t, "id", "amount")
+	f.badValue = "oops"
+	_, err := UpsertCSV(context.Background(), f.db, "claims", []string{"id"}, nil, strings.NewReader(b.String()),
+		WithLogger(discardLogger{}))
+	if err == nil || !strings.Contains(err.Error(), "line 6: ") {
+		t.Errorf("got %v, want an error from line 6", err)
+	}
+}
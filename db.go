@@ -0,0 +1,42 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DB is what the load functions run their SQL on. *sql.DB and *sql.Conn
+// both implement it, and so can wrappers adding e.g. tracing.
+//
+// Temp tables only exist for the session that created them, so a load
+// needs every statement to go to the same connection. If db has a Conn
+// method like *sql.DB's, a load takes one connection from it for its whole
+// run; otherwise db itself must always use the same connection, as a
+// *sql.Conn does.
+type DB interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// connector is a DB that can hand out single connections, like *sql.DB.
+type connector interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+// session returns a DB bound to a single connection for a load, along with
+// a func giving it back once the load is done.
+func session(ctx context.Context, db DB) (DB, func() error, error) {
+	pool, ok := db.(connector)
+	if !ok {
+		return db, func() error { return nil }, nil
+	}
+
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Close, nil
+}
@@ -0,0 +1,86 @@
+package bloomdb
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// DeleteByIDs deletes the rows of table whose idColumns match one of ids,
+// each of which holds the key of a row to delete in the order of idColumns.
+// Like a load, the ids are copied into a temp table first, so there's no
+// giant IN list for the planner to choke on, and the rows are deleted with a
+// single join. It returns how many rows were deleted.
+func DeleteByIDs(ctx context.Context, db DB, table string, idColumns []string, ids chan []string, opts ...Option) (int64, error) {
+	o := newOptions(opts)
+	if len(idColumns) == 0 {
+		return 0, errors.New("bloomdb: at least one id column is required")
+	}
+
+	tempTable, err := o.tempTableFor(table)
+	if err != nil {
+		return 0, err
+	}
+
+	dialect := o.dialect
+	quote := dialect.QuoteIdentifier
+	info := upsertInfo{
+		Table:           quoteQualified(quote, table),
+		TempTable:       quote(tempTable),
+		IdColumns:       quoteAll(quote, idColumns),
+		ConflictColumns: quoteAll(quote, idColumns),
+	}
+	query, err := renderTemplate(o.sqlTemplates(), "deletebyids.sql.template", info)
+	if err != nil {
+		return 0, err
+	}
+
+	// The temp table only gets the id columns, since LIKE would bring along
+	// the NOT NULL constraints of the others.
+	st := Statements{
+		TempTable: tempTable,
+		CreateTempTable: "CREATE TEMPORARY TABLE " + info.TempTable + " AS SELECT " +
+			strings.Join(info.IdColumns, ", ") + " FROM " + info.Table + " LIMIT 0",
+		DropTempTable: dialect.DropTempTableSQL(tempTable),
+	}
+
+	conn, release, err := session(ctx, db)
+	if err != nil {
+		return 0, phaseError(table, "connect", err)
+	}
+	defer release()
+	defer dropTempTable(conn, db, st)
+
+	stats := UpsertStats{}
+	err = copyRows(ctx, conn, st, table, idColumns, checkedRows(stringRows(ids), len(idColumns)), o, &stats)
+	if err != nil {
+		return 0, err
+	}
+
+	if !o.skipAnalyze {
+		err = analyze(ctx, conn, table, dialect.AnalyzeSQL(tempTable), o)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	txn, err := beginTx(ctx, conn, o)
+	if err != nil {
+		return 0, phaseError(table, "delete", err)
+	}
+	defer txn.Rollback()
+
+	o.logger.Printf("Deleting %d ids from %s...", stats.RowsCopied, table)
+	res, err := txn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, phaseError(table, "delete", err)
+	}
+	deleted, _ := res.RowsAffected()
+
+	err = txn.Commit()
+	if err != nil {
+		return 0, phaseError(table, "commit", err)
+	}
+	o.logger.Printf("Deleted %d rows", deleted)
+	return deleted, nil
+}
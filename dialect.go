@@ -0,0 +1,398 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect adapts a load to a particular database. Loads use PostgresDialect
+// unless WithDialect says otherwise.
+//
+// Table names passed to a Dialect may be schema-qualified; every other name
+// is a single identifier. Names are passed unquoted, and the Dialect quotes
+// them itself.
+type Dialect interface {
+	// QuoteIdentifier quotes a single identifier, such as a column name.
+	QuoteIdentifier(name string) string
+	// ColumnsQuery returns a query listing the name and data type of each
+	// insertable column of table in order, along with its arguments.
+	ColumnsQuery(table string) (string, []interface{})
+	// Templates holds the dialect's upsert.sql.template,
+	// updaterevisions.sql.template, deletemissing.sql.template,
+	// softdelete.sql.template, deletebyids.sql.template, update.sql.template,
+	// watermark.sql.template and unmatched.sql.template, and
+	// merge.sql.template if the dialect supports WithMerge.
+	Templates() fs.FS
+	// CreateTempTableSQL returns the statement creating tempTable with the
+	// same columns as table, and whatever else of table's includes asks for.
+	CreateTempTableSQL(table string, tempTable string, includes TempTableIncludes) string
+	// DropTempTableSQL returns the statement dropping tempTable, if it exists.
+	DropTempTableSQL(tempTable string) string
+	// CreateStagingTableSQL returns the statement creating stagingTable, a
+	// regular table visible to every connection, with the same columns as
+	// table. It's used instead of a temp table for parallel loads.
+	CreateStagingTableSQL(table string, stagingTable string, includes TempTableIncludes) string
+	// DropStagingTableSQL returns the statement dropping stagingTable, if it
+	// exists.
+	DropStagingTableSQL(stagingTable string) string
+	// UniqueIndexSQL returns the statement adding a unique index named
+	// indexName over columns to tempTable, or "" if the temp table already
+	// has one.
+	UniqueIndexSQL(tempTable string, indexName string, columns []string) string
+	// AnalyzeSQL returns the statement refreshing table's planner statistics.
+	AnalyzeSQL(table string) string
+	// BulkLoad starts copying rows of the given columns into tempTable as
+	// part of txn.
+	BulkLoad(ctx context.Context, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error)
+	// BulkLoadSQL describes the statement BulkLoad sends rows with.
+	BulkLoadSQL(tempTable string, columns []string) string
+	// TruncateSQL returns the statement emptying table inside a transaction,
+	// also emptying the tables referencing it if cascade is set.
+	TruncateSQL(table string, cascade bool) string
+	// StatementTimeoutSQL returns the statement limiting how long each
+	// following statement of a transaction may run, or "" if the dialect
+	// can't.
+	StatementTimeoutSQL(d time.Duration) string
+	// PartitionKeyQuery returns a query listing the partition key columns of
+	// table in order, or no rows if it isn't partitioned, along with its
+	// arguments. It returns "" if the dialect doesn't need upserts into
+	// partitioned tables adjusted.
+	PartitionKeyQuery(table string) (string, []interface{})
+	// UniqueKeyQuery returns a query whose single boolean result says
+	// whether table has a unique index over exactly columns, along with its
+	// arguments.
+	UniqueKeyQuery(table string, columns []string) (string, []interface{})
+	// TableTypeQuery returns a query whose single row gives the schema of
+	// table and its table_type in information_schema.tables, such as
+	// "BASE TABLE" or "VIEW", along with its arguments.
+	TableTypeQuery(table string) (string, []interface{})
+	// Upsert runs the rendered upsert query and reports how many rows it
+	// inserted and updated. Rows of tempTable match those of table on
+	// conflictColumns. If changed isn't nil, it's also called with the
+	// idColumns of each row upserted, and the query was rendered with
+	// ReturnIDs set.
+	Upsert(ctx context.Context, txn *sql.Tx, table string, tempTable string, idColumns []string, conflictColumns []string, query string, changed func(id []string, inserted bool) error) (inserted int64, updated int64, err error)
+}
+
+// BulkLoader copies rows into a temp table for a Dialect.
+type BulkLoader interface {
+	// WriteRow adds a row to the load. It may be buffered until Close.
+	WriteRow(ctx context.Context, row []interface{}) error
+	// Close flushes any buffered rows and ends the load.
+	Close(ctx context.Context) error
+}
+
+// ConnDialect is a Dialect whose bulk load runs on the driver connection
+// itself rather than through database/sql, such as bloompgx's. Loads use
+// BulkLoadConn instead of BulkLoad whenever they run on a *sql.Conn, which
+// they do when given a *sql.DB or a *sql.Conn.
+type ConnDialect interface {
+	Dialect
+	// BulkLoadConn is like BulkLoad, with conn being the connection txn runs
+	// on.
+	BulkLoadConn(ctx context.Context, conn *sql.Conn, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error)
+}
+
+// bulkLoad starts a bulk load with dialect, through BulkLoadConn if it's
+// a ConnDialect and conn is a *sql.Conn.
+func bulkLoad(ctx context.Context, dialect Dialect, conn DB, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error) {
+	if connDialect, ok := dialect.(ConnDialect); ok {
+		if sqlConn, ok := conn.(*sql.Conn); ok {
+			return connDialect.BulkLoadConn(ctx, sqlConn, txn, tempTable, columns)
+		}
+	}
+	return dialect.BulkLoad(ctx, txn, tempTable, columns)
+}
+
+var postgresTemplates = mustSub(sqlTemplates, "sql")
+
+// PostgresDialect loads into Postgres with COPY and INSERT ... ON CONFLICT. It
+// needs the lib/pq driver.
+type PostgresDialect struct{}
+
+func (PostgresDialect) QuoteIdentifier(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+func (PostgresDialect) ColumnsQuery(table string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	return `SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2
+			AND is_generated = 'NEVER' AND (is_identity = 'NO' OR identity_generation = 'BY DEFAULT')
+		ORDER BY ordinal_position`, []interface{}{schema, name}
+}
+
+func (PostgresDialect) Templates() fs.FS {
+	return postgresTemplates
+}
+
+func (PostgresDialect) CreateTempTableSQL(table string, tempTable string, includes TempTableIncludes) string {
+	return "CREATE TEMP TABLE " + pq.QuoteIdentifier(tempTable) + "(LIKE " + quoteQualified(pq.QuoteIdentifier, table) + likeIncludes(includes) + ")"
+}
+
+// likeIncludes returns the INCLUDING clauses of a LIKE for includes.
+func likeIncludes(includes TempTableIncludes) string {
+	if includes&IncludeAll == IncludeAll {
+		return " INCLUDING ALL"
+	}
+	clauses := ""
+	if includes&IncludeDefaults != 0 {
+		clauses += " INCLUDING DEFAULTS"
+	}
+	if includes&IncludeConstraints != 0 {
+		clauses += " INCLUDING CONSTRAINTS"
+	}
+	return clauses
+}
+
+func (PostgresDialect) DropTempTableSQL(tempTable string) string {
+	// Only look in pg_temp so a regular table of the same name is never
+	// touched.
+	return "DROP TABLE IF EXISTS pg_temp." + pq.QuoteIdentifier(tempTable)
+}
+
+func (PostgresDialect) CreateStagingTableSQL(table string, stagingTable string, includes TempTableIncludes) string {
+	return "CREATE UNLOGGED TABLE " + pq.QuoteIdentifier(stagingTable) + "(LIKE " + quoteQualified(pq.QuoteIdentifier, table) + likeIncludes(includes) + ")"
+}
+
+func (PostgresDialect) DropStagingTableSQL(stagingTable string) string {
+	return "DROP TABLE IF EXISTS " + pq.QuoteIdentifier(stagingTable)
+}
+
+// UniqueIndexSQL uses IF NOT EXISTS, so that a reused temp table that already
+// has the index skips it.
+func (PostgresDialect) UniqueIndexSQL(tempTable string, indexName string, columns []string) string {
+	return "CREATE UNIQUE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(indexName) + " ON " +
+		pq.QuoteIdentifier(tempTable) + "(" + strings.Join(quoteAll(pq.QuoteIdentifier, columns), ", ") + ")"
+}
+
+func (PostgresDialect) AnalyzeSQL(table string) string {
+	return "ANALYZE " + quoteQualified(pq.QuoteIdentifier, table)
+}
+
+func (PostgresDialect) BulkLoad(ctx context.Context, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error) {
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn(tempTable, columns...))
+	if err != nil {
+		return nil, err
+	}
+
+	return copyLoader{stmt}, nil
+}
+
+func (PostgresDialect) BulkLoadSQL(tempTable string, columns []string) string {
+	return pq.CopyIn(tempTable, columns...)
+}
+
+func (PostgresDialect) TruncateSQL(table string, cascade bool) string {
+	query := "TRUNCATE " + quoteQualified(pq.QuoteIdentifier, table)
+	if cascade {
+		query += " CASCADE"
+	}
+	return query
+}
+
+func (PostgresDialect) StatementTimeoutSQL(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return "SET LOCAL statement_timeout = " + strconv.FormatInt(ms, 10)
+}
+
+func (PostgresDialect) PartitionKeyQuery(table string) (string, []interface{}) {
+	return `SELECT a.attname FROM pg_partitioned_table p
+		JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = ANY (p.partattrs)
+		WHERE p.partrelid = $1::regclass
+		ORDER BY array_position(p.partattrs::int2[], a.attnum)`, []interface{}{quoteQualified(pq.QuoteIdentifier, table)}
+}
+
+// UniqueKeyQuery only counts plain unique indexes: not partial ones, and
+// not ones over expressions.
+func (PostgresDialect) UniqueKeyQuery(table string, columns []string) (string, []interface{}) {
+	sorted := append([]string{}, columns...)
+	sort.Strings(sorted)
+	return `SELECT EXISTS (
+		SELECT 1 FROM pg_index i
+		WHERE i.indrelid = $1::regclass AND i.indisunique AND i.indpred IS NULL
+			AND i.indnkeyatts = cardinality($2::text[])
+			AND (SELECT array_agg(a.attname::text ORDER BY a.attname) FROM pg_attribute a
+				WHERE a.attrelid = i.indrelid AND a.attnum = ANY ((i.indkey::int2[])[0:i.indnkeyatts - 1])) = $2::text[]
+	)`, []interface{}{quoteQualified(pq.QuoteIdentifier, table), pq.StringArray(sorted)}
+}
+
+func (PostgresDialect) TableTypeQuery(table string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	return `SELECT table_schema, table_type FROM information_schema.tables
+		WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2`, []interface{}{schema, name}
+}
+
+func (PostgresDialect) Upsert(ctx context.Context, txn *sql.Tx, table string, tempTable string, idColumns []string, conflictColumns []string, query string, changed func(id []string, inserted bool) error) (int64, int64, error) {
+	var inserted, updated int64
+	if changed == nil {
+		err := txn.QueryRowContext(ctx, query).Scan(&inserted, &updated)
+		return inserted, updated, err
+	}
+
+	rows, err := txn.QueryContext(ctx, query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	inserted, updated, err = scanChanged(rows, len(idColumns), changed)
+	return inserted, updated, err
+}
+
+// scanChanged reads rows of key columns followed by a bool saying whether
+// the row was inserted, passing each to changed and counting them.
+func scanChanged(rows *sql.Rows, keyColumns int, changed func(id []string, inserted bool) error) (int64, int64, error) {
+	var inserted, updated int64
+	for rows.Next() {
+		id := make([]sql.NullString, keyColumns)
+		dest := make([]interface{}, keyColumns+1)
+		for i := range id {
+			dest[i] = &id[i]
+		}
+		var wasInserted bool
+		dest[keyColumns] = &wasInserted
+		if err := rows.Scan(dest...); err != nil {
+			return 0, 0, err
+		}
+
+		key := make([]string, keyColumns)
+		for i, value := range id {
+			key[i] = value.String
+		}
+		if err := changed(key, wasInserted); err != nil {
+			return 0, 0, err
+		}
+
+		if wasInserted {
+			inserted++
+		} else {
+			updated++
+		}
+	}
+	return inserted, updated, rows.Err()
+}
+
+// countedUpsert runs an upsert query that can't report what it did itself,
+// first joining tempTable to table on conflictColumns to count the rows that
+// will be inserted and updated, and to pass their keys to changed.
+func countedUpsert(ctx context.Context, txn *sql.Tx, quote func(string) string, table string, tempTable string, idColumns []string, conflictColumns []string, query string, changed func(id []string, inserted bool) error) (int64, int64, error) {
+	table = quoteQualified(quote, table)
+	tempTable = quote(tempTable)
+	idColumns = quoteAll(quote, idColumns)
+	conflictColumns = quoteAll(quote, conflictColumns)
+
+	if len(conflictColumns) == 0 {
+		res, err := txn.ExecContext(ctx, query)
+		if err != nil {
+			return 0, 0, err
+		}
+		inserted, err := res.RowsAffected()
+		return inserted, 0, err
+	}
+
+	conditions := make([]string, len(conflictColumns))
+	for i, column := range conflictColumns {
+		conditions[i] = tempTable + "." + column + " = " + table + "." + column
+	}
+
+	join := tempTable + " LEFT JOIN " + table + " ON " + strings.Join(conditions, " AND ")
+
+	var inserted, updated int64
+	if changed == nil {
+		var total int64
+		err := txn.QueryRowContext(ctx, "SELECT COUNT(*), COUNT("+table+"."+conflictColumns[0]+") FROM "+join).Scan(&total, &updated)
+		if err != nil {
+			return 0, 0, err
+		}
+		inserted = total - updated
+	} else {
+		keys := make([]string, len(idColumns))
+		for i, column := range idColumns {
+			keys[i] = tempTable + "." + column
+		}
+		rows, err := txn.QueryContext(ctx, "SELECT "+strings.Join(keys, ", ")+", "+table+"."+conflictColumns[0]+" IS NULL FROM "+join)
+		if err != nil {
+			return 0, 0, err
+		}
+		inserted, updated, err = scanChanged(rows, len(idColumns), changed)
+		rows.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	_, err := txn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return inserted, updated, nil
+}
+
+// copyLoader feeds rows to a prepared COPY statement.
+type copyLoader struct {
+	stmt *sql.Stmt
+}
+
+func (l copyLoader) WriteRow(ctx context.Context, row []interface{}) error {
+	convertArrays(row)
+	_, err := l.stmt.ExecContext(ctx, row...)
+	return err
+}
+
+// convertArrays wraps the slices in row so they're sent as Postgres array
+// literals. An empty slice, even a nil one, is an empty array rather than
+// NULL.
+func convertArrays(row []interface{}) {
+	for i, value := range row {
+		switch v := value.(type) {
+		case []string:
+			if v == nil {
+				v = []string{}
+			}
+			row[i] = pq.StringArray(v)
+		case []int64:
+			if v == nil {
+				v = []int64{}
+			}
+			row[i] = pq.Int64Array(v)
+		case []float64:
+			if v == nil {
+				v = []float64{}
+			}
+			row[i] = pq.Float64Array(v)
+		case []bool:
+			if v == nil {
+				v = []bool{}
+			}
+			row[i] = pq.BoolArray(v)
+		}
+	}
+}
+
+func (l copyLoader) Close(ctx context.Context) error {
+	_, err := l.stmt.ExecContext(ctx)
+	closeErr := l.stmt.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
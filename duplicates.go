@@ -0,0 +1,130 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// dedupe deletes the rows of the temp table that a later row has the same
+// key as, counting them in stats.
+func dedupe(ctx context.Context, conn execQuerier, st Statements, table string, opts *options, stats *UpsertStats) error {
+	opts.logger.Printf("Dropping duplicate rows...")
+	ctx, span := opts.startPhase(ctx, table, "dedupe")
+	res, err := conn.ExecContext(ctx, st.Dedupe)
+	if err == nil {
+		stats.RowsDuplicate, _ = res.RowsAffected()
+		span.SetCount("rows_duplicate", stats.RowsDuplicate)
+	}
+	span.End(err)
+	if err != nil {
+		return phaseError(table, "dedupe", err)
+	}
+	opts.logger.Printf("Dropped %d duplicate rows", stats.RowsDuplicate)
+	return nil
+}
+
+// duplicateSample is how many duplicate keys an ErrDuplicateKeys error
+// lists.
+const duplicateSample = 10
+
+// checkDuplicates explains a failure to build the temp table's unique index
+// over keyColumns. If the temp table has duplicate keys, it returns an error
+// wrapping ErrDuplicateKeys that lists some of them; otherwise, or if they
+// can't be looked up, e.g. because the failure aborted the transaction, it
+// returns indexErr.
+func checkDuplicates(ctx context.Context, db querier, st Statements, keyColumns []string, opts *options, indexErr error) error {
+	quote := opts.dialect.QuoteIdentifier
+	keys := strings.Join(quoteAll(quote, keyColumns), ", ")
+	query := "SELECT " + keys + ", COUNT(*) FROM " + quote(st.TempTable) +
+		" GROUP BY " + keys + " HAVING COUNT(*) > 1 LIMIT " + fmt.Sprint(duplicateSample)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return indexErr
+	}
+	defer rows.Close()
+
+	duplicates := []string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(keyColumns))
+		dest := make([]interface{}, len(keyColumns)+1)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		var count int
+		dest[len(keyColumns)] = &count
+		if err := rows.Scan(dest...); err != nil {
+			return indexErr
+		}
+
+		pairs := make([]string, len(keyColumns))
+		for i, column := range keyColumns {
+			pairs[i] = column + "=" + values[i].String
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%s (%d rows)", strings.Join(pairs, ", "), count))
+	}
+	if rows.Err() != nil || len(duplicates) == 0 {
+		return indexErr
+	}
+
+	return fmt.Errorf("%w: %s", ErrDuplicateKeys, strings.Join(duplicates, "; "))
+}
+
+// batchDuplicates explains a cardinality violation (21000) from upserting
+// batch, the rows of columns, straight into the table: ON CONFLICT can't
+// change a row twice, so the batch had duplicate keys. It returns an error
+// wrapping ErrDuplicateKeys that lists some of the keys it finds by
+// comparing their values, or that wraps upsertErr if it finds none, e.g.
+// because the keys only match once the server has parsed them. Any other
+// upsertErr is returned as it is.
+func batchDuplicates(batch [][]interface{}, columns []string, keyColumns []string, upsertErr error) error {
+	if sqlState(upsertErr) != "21000" {
+		return upsertErr
+	}
+
+	positions := make([]int, len(keyColumns))
+	for i, column := range keyColumns {
+		positions[i] = indexOf(columns, column)
+		if positions[i] < 0 {
+			return fmt.Errorf("%w: %v", ErrDuplicateKeys, upsertErr)
+		}
+	}
+
+	counts := map[string]int{}
+	keys := []string{}
+	for _, row := range batch {
+		pairs := make([]string, len(keyColumns))
+		null := false
+		for i, column := range keyColumns {
+			value := row[positions[i]]
+			// A NULL key never conflicts.
+			if value == nil {
+				null = true
+				break
+			}
+			pairs[i] = column + "=" + fmt.Sprint(value)
+		}
+		if null {
+			continue
+		}
+		key := strings.Join(pairs, ", ")
+		counts[key]++
+		if counts[key] == 2 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: %v", ErrDuplicateKeys, upsertErr)
+	}
+	if len(keys) > duplicateSample {
+		keys = keys[:duplicateSample]
+	}
+
+	duplicates := make([]string, len(keys))
+	for i, key := range keys {
+		duplicates[i] = fmt.Sprintf("%s (%d rows)", key, counts[key])
+	}
+	return fmt.Errorf("%w: %s", ErrDuplicateKeys, strings.Join(duplicates, "; "))
+}
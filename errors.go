@@ -0,0 +1,49 @@
+package bloomdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrColumnMismatch is returned, wrapped, when the columns of a load
+	// don't match the table, e.g. a loaded column the table doesn't have.
+	ErrColumnMismatch = errors.New("bloomdb: column mismatch")
+	// ErrNoColumns is returned, wrapped, when no columns are given and none
+	// can be found on the table.
+	ErrNoColumns = errors.New("bloomdb: no columns to load")
+	// ErrDuplicateKeys is returned, wrapped, when several input rows have
+	// the same key, so the temp table's unique index can't be built. The
+	// error lists some of the keys.
+	ErrDuplicateKeys = errors.New("bloomdb: duplicate keys in the input")
+	// ErrValidationFailed is returned, wrapped, when WithValidateSQL's query
+	// counts any violations. The error gives the count.
+	ErrValidationFailed = errors.New("bloomdb: validation failed")
+)
+
+// UpsertError is returned when a phase of a load fails, such as the copy or
+// the upsert. It wraps the error the phase failed with, so errors.As can
+// still find e.g. a *pq.Error.
+type UpsertError struct {
+	Table string
+	// Phase names the step that failed: "create table", "detect columns",
+	// "connect", "session settings", "create temp table", "copy",
+	// "watermark", "dedupe", "index", "analyze", "lock", "count",
+	// "validate", "truncate", "revisions", "upsert", "delete missing",
+	// "soft delete", "vacuum", "on success", "delete" or "commit".
+	Phase string
+	Err   error
+}
+
+func (e *UpsertError) Error() string {
+	return fmt.Sprintf("bloomdb: %s phase failed for table %s: %v", e.Phase, e.Table, e.Err)
+}
+
+func (e *UpsertError) Unwrap() error {
+	return e.Err
+}
+
+// phaseError adds the table and the phase of the load that failed to err.
+func phaseError(table string, phase string, err error) error {
+	return &UpsertError{Table: table, Phase: phase, Err: err}
+}
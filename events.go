@@ -0,0 +1,66 @@
+package bloomdb
+
+import "context"
+
+// EventPhase says which step of a load an Event marks.
+type EventPhase int
+
+const (
+	// EventStart is sent once a load has worked out its columns and its
+	// statements, before it copies any rows.
+	EventStart EventPhase = iota
+	// EventCopyProgress is sent while rows are copied into the temp table,
+	// every 100000 rows or as often as WithProgressInterval says.
+	EventCopyProgress
+	// EventCopyDone is sent once every row has been copied.
+	EventCopyDone
+	// EventIndexDone is sent once the temp table's unique index is built.
+	EventIndexDone
+	// EventAnalyzeDone is sent once the temp table has been analyzed.
+	EventAnalyzeDone
+	// EventRevisionsDone is sent once the revisions of the changed rows
+	// have been bumped.
+	EventRevisionsDone
+	// EventUpsertDone is sent once the upsert, and the deletion of missing
+	// rows, have run, before they're committed.
+	EventUpsertDone
+	// EventCommitted is sent once the upsert has committed.
+	EventCommitted
+)
+
+// Event marks a step of a load, for WithEvents.
+type Event struct {
+	Phase EventPhase
+	Table string
+	// Stats are the load's stats as of the event, e.g. the rows copied so
+	// far for EventCopyProgress.
+	Stats UpsertStats
+}
+
+// WithEvents sends an Event to ch as the load reaches each step, in the
+// order of EventPhase, skipping the steps the load doesn't take, e.g.
+// EventIndexDone without id columns or EventRevisionsDone without
+// WithRevisions. A load small enough to skip the temp table only sends
+// EventStart, EventCopyDone, EventUpsertDone and EventCommitted, and
+// UpsertTx never sends EventCommitted, since its caller commits. An upsert
+// retried by WithRetry sends EventRevisionsDone and EventUpsertDone again.
+//
+// The load never closes ch, and waits on every send unless its context is
+// done, so ch must be read concurrently. A nil ch sends nothing.
+func WithEvents(ch chan<- Event) Option {
+	return func(o *options) {
+		o.events = ch
+	}
+}
+
+// sendEvent sends an event for phase of a load into table to opts.events,
+// if it's set.
+func (o *options) sendEvent(ctx context.Context, phase EventPhase, table string, stats *UpsertStats) {
+	if o.events == nil {
+		return
+	}
+	select {
+	case o.events <- Event{Phase: phase, Table: table, Stats: *stats}:
+	case <-ctx.Done():
+	}
+}
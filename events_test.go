@@ -0,0 +1,106 @@
+package bloomdb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		rows int
+		opts []Option
+		want []EventPhase
+	}{
+		{
+			name: "temp table",
+			rows: 3,
+			opts: []Option{WithSmallBatchThreshold(0), WithRevisions()},
+			want: []EventPhase{EventStart, EventCopyDone, EventIndexDone, EventAnalyzeDone, EventRevisionsDone, EventUpsertDone, EventCommitted},
+		},
+		{
+			name: "progress",
+			rows: 5,
+			opts: []Option{WithSmallBatchThreshold(0), WithProgressInterval(2), WithSkipAnalyze()},
+			want: []EventPhase{EventStart, EventCopyProgress, EventCopyProgress, EventCopyDone, EventIndexDone, EventUpsertDone, EventCommitted},
+		},
+		{
+			name: "small batch",
+			rows: 3,
+			want: []EventPhase{EventStart, EventCopyDone, EventUpsertDone, EventCommitted},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			events := make(chan Event, 100)
+			opts := append([]Option{WithLogger(discardLogger{}), WithEvents(events)}, test.opts...)
+			_, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"},
+				rowsOf(numberedRows(test.rows)...), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(events)
+
+			var got []EventPhase
+			for event := range events {
+				if event.Table != "claims" {
+					t.Errorf("got an event for table %q, want claims", event.Table)
+				}
+				got = append(got, event.Phase)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got phases %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventStats(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	events := make(chan Event, 100)
+	_, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"},
+		rowsOf(numberedRows(3)...), WithLogger(discardLogger{}), WithSmallBatchThreshold(0), WithEvents(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	for event := range events {
+		switch event.Phase {
+		case EventStart:
+			if event.Stats.RowsCopied != 0 {
+				t.Errorf("got %d rows copied at the start", event.Stats.RowsCopied)
+			}
+		case EventCopyDone:
+			if event.Stats.RowsCopied != 3 {
+				t.Errorf("got %d rows copied once the copy was done, want 3", event.Stats.RowsCopied)
+			}
+		case EventCommitted:
+			if event.Stats.RowsInserted != 3 {
+				t.Errorf("got %d rows inserted once committed, want 3", event.Stats.RowsInserted)
+			}
+		}
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	stats := &UpsertStats{RowsCopied: 7}
+
+	// A nil channel sends nothing, and never blocks.
+	newOptions(nil).sendEvent(context.Background(), EventStart, "claims", stats)
+
+	// An unread channel doesn't block a load whose context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newOptions([]Option{WithEvents(make(chan Event))}).sendEvent(ctx, EventStart, "claims", stats)
+
+	events := make(chan Event, 1)
+	newOptions([]Option{WithEvents(events)}).sendEvent(context.Background(), EventCopyDone, "claims", stats)
+	stats.RowsCopied = 8
+	if got := <-events; got.Phase != EventCopyDone || got.Table != "claims" || got.Stats.RowsCopied != 7 {
+		t.Errorf("got %+v, want a copy of the stats as they were sent", got)
+	}
+}
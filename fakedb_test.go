@@ -0,0 +1,377 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver that records the statements a load runs
+// and answers them well enough for the load to go through, for testing
+// loads without a database. Every connection of db shares it.
+type fakeDB struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// columns are the target table's, all reported as text.
+	columns []string
+	// tableType is the target's information_schema table_type.
+	tableType string
+	// counts answer the SELECT count(*) queries, in order, then 0.
+	counts []int64
+	// badValue makes any row holding it fail to copy.
+	badValue string
+	// source answers SELECT * FROM source, as the rows of a load from
+	// another query.
+	source *fakeRows
+	// partitionKey is the target's partition key, if it's partitioned.
+	partitionKey []string
+	failures     []*fakeFailure
+
+	statements []string
+	// tables holds the tables created and not yet dropped, with the rows
+	// copied into each.
+	tables map[string]int
+	// copied holds the values of every row copied.
+	copied [][]driver.Value
+}
+
+// fakeFailure fails the next times statements containing query with err.
+type fakeFailure struct {
+	query string
+	err   error
+	times int
+}
+
+func newFakeDB(t *testing.T, columns ...string) *fakeDB {
+	f := &fakeDB{columns: columns, tableType: "BASE TABLE", tables: map[string]int{}}
+	f.db = sql.OpenDB(f)
+	t.Cleanup(func() { f.db.Close() })
+	return f
+}
+
+// fail makes the next times statements containing query fail with err.
+func (f *fakeDB) fail(query string, err error, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &fakeFailure{query: query, err: err, times: times})
+}
+
+// ran returns how many statements starting with prefix were run.
+func (f *fakeDB) ran(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, statement := range f.statements {
+		if strings.HasPrefix(statement, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// index returns the position of the first statement starting with prefix
+// in the order they ran, or -1.
+func (f *fakeDB) index(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, statement := range f.statements {
+		if strings.HasPrefix(statement, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// leftover returns the tables that were created and never dropped.
+func (f *fakeDB) leftover() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.tables {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{f}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+// run records query and returns its result.
+func (f *fakeDB) run(query string, args []driver.NamedValue) (driver.Rows, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, query)
+
+	for _, failure := range f.failures {
+		if failure.times > 0 && strings.Contains(query, failure.query) {
+			failure.times--
+			return nil, 0, failure.err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(query, "CREATE TEMP TABLE "), strings.HasPrefix(query, "CREATE UNLOGGED TABLE "):
+		f.tables[firstIdentifier(query)] = 0
+	case strings.HasPrefix(query, "DROP TABLE "):
+		delete(f.tables, firstIdentifier(query))
+	case strings.HasPrefix(query, "SELECT column_name"):
+		rows := &fakeRows{columns: []string{"column_name", "data_type"}}
+		for _, column := range f.columns {
+			rows.values = append(rows.values, []driver.Value{column, "text"})
+		}
+		return rows, 0, nil
+	case strings.HasPrefix(query, "SELECT table_schema, table_type"):
+		return &fakeRows{columns: []string{"table_schema", "table_type"}, values: [][]driver.Value{{"public", f.tableType}}}, 0, nil
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{true}}}, 0, nil
+	case strings.Contains(query, "count(*) FILTER"):
+		inserted := int64(len(args) / len(f.columns))
+		if len(args) == 0 {
+			for _, n := range f.tables {
+				inserted += int64(n)
+			}
+		}
+		return &fakeRows{columns: []string{"inserted", "updated"}, values: [][]driver.Value{{inserted, int64(0)}}}, 0, nil
+	case strings.HasPrefix(query, "SELECT count(*)"):
+		n := int64(0)
+		if len(f.counts) > 0 {
+			n, f.counts = f.counts[0], f.counts[1:]
+		}
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{n}}}, 0, nil
+	case strings.HasPrefix(query, "SELECT a.attname FROM pg_partitioned_table"):
+		rows := &fakeRows{columns: []string{"attname"}}
+		for _, column := range f.partitionKey {
+			rows.values = append(rows.values, []driver.Value{column})
+		}
+		return rows, 0, nil
+	case query == "SELECT * FROM source" && f.source != nil:
+		source := *f.source
+		return &source, 0, nil
+	case strings.HasPrefix(query, "SHOW server_version_num"):
+		return &fakeRows{columns: []string{"server_version_num"}, values: [][]driver.Value{{int64(160000)}}}, 0, nil
+	}
+	return &fakeRows{columns: []string{"?column?"}}, 0, nil
+}
+
+// copyRow records row as copied into table, unless it holds badValue.
+func (f *fakeDB) copyRow(table string, row []driver.Value) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, failure := range f.failures {
+		if failure.times > 0 && strings.Contains("COPY "+table, failure.query) {
+			failure.times--
+			return failure.err
+		}
+	}
+	for _, value := range row {
+		if s, ok := value.(string); ok && f.badValue != "" && s == f.badValue {
+			return errors.New("invalid input syntax for type integer: " + s)
+		}
+	}
+	f.tables[table]++
+	f.copied = append(f.copied, append([]driver.Value{}, row...))
+	return nil
+}
+
+// firstIdentifier returns the first double-quoted identifier in query.
+func firstIdentifier(query string) string {
+	start := strings.Index(query, `"`)
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(query[start+1:], `"`)
+	if end < 0 {
+		return ""
+	}
+	return query[start+1 : start+1+end]
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("fakeDB can only be opened with sql.OpenDB")
+}
+
+type fakeConn struct {
+	f *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.HasPrefix(query, "COPY ") {
+		c.f.mu.Lock()
+		c.f.statements = append(c.f.statements, query)
+		c.f.mu.Unlock()
+	}
+	return &fakeStmt{f: c.f, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if _, _, err := c.f.run("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return &fakeTx{c.f}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, n, err := c.f.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, _, err := c.f.run(query, args)
+	return rows, err
+}
+
+// CheckNamedValue takes arguments of any type, as lib/pq's COPY does.
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+type fakeTx struct {
+	f *fakeDB
+}
+
+func (tx *fakeTx) Commit() error {
+	_, _, err := tx.f.run("COMMIT", nil)
+	return err
+}
+
+func (tx *fakeTx) Rollback() error {
+	_, _, err := tx.f.run("ROLLBACK", nil)
+	return err
+}
+
+// fakeStmt is a prepared statement. A COPY takes a row with each Exec, and
+// ends with an Exec without arguments.
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(s.query, "COPY ") {
+		if len(args) == 0 {
+			return driver.RowsAffected(0), nil
+		}
+		return driver.RowsAffected(1), s.f.copyRow(firstIdentifier(s.query), args)
+	}
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	_, n, err := s.f.run(s.query, named)
+	return driver.RowsAffected(n), err
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	rows, _, err := s.f.run(s.query, named)
+	return rows, err
+}
+
+type fakeRows struct {
+	columns []string
+	// types are the database types of columns, or empty for unknown.
+	types  []string
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.types) {
+		return r.types[index]
+	}
+	return ""
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// discardLogger drops everything the load logs.
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+
+// rowsOf returns a closed channel holding rows.
+func rowsOf(rows ...[]string) chan []string {
+	ch := make(chan []string, len(rows))
+	for _, row := range rows {
+		ch <- row
+	}
+	close(ch)
+	return ch
+}
+
+// readAll reads every row of rows, stopping at the first error.
+func readAll(rows rowSource) ([][]interface{}, error) {
+	var all [][]interface{}
+	for {
+		row, ok, err := rows(context.Background())
+		if err != nil || !ok {
+			return all, err
+		}
+		all = append(all, row)
+	}
+}
+
+// numberedRows returns n rows of id and amount.
+func numberedRows(n int) [][]string {
+	rows := make([][]string, n)
+	for i := range rows {
+		rows[i] = []string{strconv.Itoa(i + 1), strconv.Itoa(i * 10)}
+	}
+	return rows
+}
+
+// upsertFake loads rows into the claims table of f through a temp table.
+func upsertFake(f *fakeDB, rows [][]string, opts ...Option) (UpsertStats, error) {
+	opts = append([]Option{WithLogger(discardLogger{}), WithSmallBatchThreshold(0)}, opts...)
+	return UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"}, rowsOf(rows...), opts...)
+}
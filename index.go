@@ -2,12 +2,13 @@ package bloomdb
 
 import (
 	"database/sql"
+	"github.com/lib/pq"
 )
 
 func CreateIndex(db *sql.DB, table string, column string) error {
-	if _, err := db.Exec("CREATE INDEX ON %s (%s)", table, column); err != nil {
+	if _, err := db.Exec("CREATE INDEX ON " + quoteQualified(pq.QuoteIdentifier, table) + " (" + pq.QuoteIdentifier(column) + ")"); err != nil {
 		return err
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,18 @@
+package bloomdb
+
+import (
+	"time"
+)
+
+// MetricsObserver receives measurements from loads, e.g. to export them to a
+// monitoring system. The bloomprom package implements it for Prometheus.
+type MetricsObserver interface {
+	// ObserveRowsCopied is called with the number of rows copied into the
+	// temp table since the last call, every WithProgressInterval rows and
+	// once more when the copy ends.
+	ObserveRowsCopied(table string, n int)
+	// ObserveDuration is called with the duration of each successful load.
+	ObserveDuration(table string, d time.Duration)
+	// ObserveError is called once for each failed load.
+	ObserveError(table string)
+}
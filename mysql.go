@@ -0,0 +1,180 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// mysqlBatchRows is how many rows MySQLDialect sends per INSERT. MySQL caps a
+// statement at 65535 placeholders, so wide tables get smaller batches.
+const mysqlBatchRows = 1000
+
+var mysqlTemplates = mustSub(sqlTemplates, "sql/mysql")
+
+// MySQLDialect loads into MySQL using multi-row INSERTs into a temporary table
+// and INSERT ... ON DUPLICATE KEY UPDATE. It works with any MySQL driver for
+// database/sql, such as github.com/go-sql-driver/mysql.
+//
+// The temp table is created with CREATE TEMPORARY TABLE ... LIKE, which also
+// copies the target's keys, so no separate unique index is built.
+type MySQLDialect struct{}
+
+func (MySQLDialect) QuoteIdentifier(name string) string {
+	return mysqlQuote(name)
+}
+
+func mysqlQuote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (MySQLDialect) ColumnsQuery(table string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	return `SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ?
+			AND extra NOT LIKE '%GENERATED%'
+		ORDER BY ordinal_position`, []interface{}{schema, name}
+}
+
+func (MySQLDialect) Templates() fs.FS {
+	return mysqlTemplates
+}
+
+// CreateTempTableSQL ignores includes, since MySQL's LIKE always copies
+// defaults and indexes.
+func (MySQLDialect) CreateTempTableSQL(table string, tempTable string, includes TempTableIncludes) string {
+	return "CREATE TEMPORARY TABLE " + mysqlQuote(tempTable) + " LIKE " + quoteQualified(mysqlQuote, table)
+}
+
+func (MySQLDialect) DropTempTableSQL(tempTable string) string {
+	return "DROP TEMPORARY TABLE IF EXISTS " + mysqlQuote(tempTable)
+}
+
+func (MySQLDialect) CreateStagingTableSQL(table string, stagingTable string, includes TempTableIncludes) string {
+	return "CREATE TABLE " + mysqlQuote(stagingTable) + " LIKE " + quoteQualified(mysqlQuote, table)
+}
+
+func (MySQLDialect) DropStagingTableSQL(stagingTable string) string {
+	return "DROP TABLE IF EXISTS " + mysqlQuote(stagingTable)
+}
+
+func (MySQLDialect) UniqueIndexSQL(tempTable string, indexName string, columns []string) string {
+	return ""
+}
+
+func (MySQLDialect) AnalyzeSQL(table string) string {
+	return "ANALYZE TABLE " + quoteQualified(mysqlQuote, table)
+}
+
+func (MySQLDialect) BulkLoad(ctx context.Context, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error) {
+	batchRows := mysqlBatchRows
+	if batchRows*len(columns) > 65535 {
+		batchRows = 65535 / len(columns)
+	}
+
+	return &insertLoader{
+		txn:       txn,
+		prefix:    mysqlInsertPrefix(tempTable, columns),
+		row:       mysqlPlaceholders(len(columns)),
+		batchRows: batchRows,
+	}, nil
+}
+
+func (MySQLDialect) BulkLoadSQL(tempTable string, columns []string) string {
+	return mysqlInsertPrefix(tempTable, columns) + mysqlPlaceholders(len(columns)) + ", ..."
+}
+
+func mysqlInsertPrefix(tempTable string, columns []string) string {
+	return "INSERT INTO " + mysqlQuote(tempTable) + " (" + strings.Join(quoteAll(mysqlQuote, columns), ", ") + ") VALUES "
+}
+
+func mysqlPlaceholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+// TruncateSQL deletes every row instead, since TRUNCATE TABLE would commit
+// the transaction. cascade is ignored, as deleting already follows the
+// foreign keys' ON DELETE rules.
+func (MySQLDialect) TruncateSQL(table string, cascade bool) string {
+	return "DELETE FROM " + quoteQualified(mysqlQuote, table)
+}
+
+// PartitionKeyQuery returns "", since ON DUPLICATE KEY UPDATE works on
+// partitioned tables as it is.
+func (MySQLDialect) PartitionKeyQuery(table string) (string, []interface{}) {
+	return "", nil
+}
+
+// StatementTimeoutSQL returns "", since MySQL's max_execution_time only
+// applies to SELECTs.
+func (MySQLDialect) StatementTimeoutSQL(d time.Duration) string {
+	return ""
+}
+
+func (MySQLDialect) UniqueKeyQuery(table string, columns []string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	args := []interface{}{schema, name}
+	for _, column := range columns {
+		args = append(args, column)
+	}
+	args = append(args, len(columns), len(columns))
+	return `SELECT EXISTS (
+		SELECT index_name FROM information_schema.statistics
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ? AND non_unique = 0
+		GROUP BY index_name
+		HAVING SUM(column_name IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + `)) = ? AND COUNT(*) = ?
+	)`, args
+}
+
+func (MySQLDialect) TableTypeQuery(table string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	return `SELECT table_schema, table_type FROM information_schema.tables
+		WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ?`, []interface{}{schema, name}
+}
+
+// Upsert counts how many of the temp table's rows already exist before
+// running the upsert, since the affected-row count MySQL reports for ON
+// DUPLICATE KEY UPDATE can't be split into inserts and updates. There's no
+// RETURNING either, so changed gets the keys from the same lookup, taking
+// them from the input rather than the table.
+func (MySQLDialect) Upsert(ctx context.Context, txn *sql.Tx, table string, tempTable string, idColumns []string, conflictColumns []string, query string, changed func(id []string, inserted bool) error) (int64, int64, error) {
+	return countedUpsert(ctx, txn, mysqlQuote, table, tempTable, idColumns, conflictColumns, query, changed)
+}
+
+// insertLoader buffers rows and writes them with multi-row INSERTs.
+type insertLoader struct {
+	txn       *sql.Tx
+	prefix    string
+	row       string
+	batchRows int
+	rows      int
+	args      []interface{}
+}
+
+func (l *insertLoader) WriteRow(ctx context.Context, row []interface{}) error {
+	l.args = append(l.args, row...)
+	l.rows++
+	if l.rows < l.batchRows {
+		return nil
+	}
+
+	return l.flush(ctx)
+}
+
+func (l *insertLoader) Close(ctx context.Context) error {
+	return l.flush(ctx)
+}
+
+func (l *insertLoader) flush(ctx context.Context) error {
+	if l.rows == 0 {
+		return nil
+	}
+
+	query := l.prefix + strings.TrimSuffix(strings.Repeat(l.row+", ", l.rows), ", ")
+	_, err := l.txn.ExecContext(ctx, query, l.args...)
+	l.rows = 0
+	l.args = l.args[:0]
+	return err
+}
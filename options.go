@@ -0,0 +1,1164 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Logger receives the progress messages written during a load. *log.Logger
+// satisfies it, so log.New(io.Discard, "", 0) silences the package.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// An Option tunes a load. Loads without options behave like the original
+// Upsert: no revisions, the standard logger and empty values loaded as NULL.
+type Option func(*options)
+
+type options struct {
+	ctx                    context.Context
+	hasRevisions           bool
+	revisionColumn         string
+	revisionStrategy       RevisionStrategy
+	revisionSavepoint      bool
+	logger                 Logger
+	nullSentinel           string
+	keepEmptyStrings       bool
+	columnTypes            map[string]string
+	caseInsensitiveColumns bool
+	converters             map[string]func(string) (interface{}, error)
+	rowFilter              func(row []string) bool
+	rowTransformer         func(row []string) []string
+	createTable            map[string]string
+	columnMapping          map[string]string
+	// json marks the loaded columns holding JSON, by position.
+	json                  []bool
+	tempTable             string
+	uniqueIndexName       string
+	includes              TempTableIncludes
+	stagingMode           StagingTableMode
+	stagingTablespace     string
+	keepStagingOnError    bool
+	skipIndex             bool
+	skipAnalyze           bool
+	analyzeTarget         bool
+	vacuumAfter           bool
+	ignoreAnalyze         bool
+	progressFunc          func(rowsProcessed int)
+	progressInterval      int
+	logEvery              int
+	copyBatchSize         int
+	flushEvery            int
+	smallBatchThreshold   int
+	deleteMissing         bool
+	softDeleteColumn      string
+	auditColumns          AuditColumns
+	changedRows           chan<- ChangedRow
+	unmatchedRows         chan<- []string
+	returnColumns         []string
+	rejectedRows          chan<- RejectedRow
+	updateColumns         []string
+	conflictColumns       []string
+	partitionKey          []string
+	updateWhere           string
+	validateSQL           string
+	expectedVersionColumn string
+	watermarkColumn       string
+	dedupeKeepLast        bool
+	watermarkValue        interface{}
+	lockMode              LockMode
+	conflictAction        ConflictAction
+	mergeStrategies       map[string]MergeStrategy
+	loadMode              LoadMode
+	useMerge              bool
+	truncateCascade       bool
+	dialect               Dialect
+	templates             fs.FS
+	metrics               MetricsObserver
+	tracer                Tracer
+	debugSQL              bool
+	rowCounts             bool
+	events                chan<- Event
+	onSuccess             func(stats UpsertStats) error
+	slog                  *slog.Logger
+	retry                 RetryPolicy
+	loadRetry             RetryPolicy
+	parallelism           int
+	isolationLevel        sql.IsolationLevel
+	statementTimeout      time.Duration
+	sessionSettings       map[string]string
+	// inputLine returns the line of the input the last row read started on,
+	// or 0 if the input has no lines.
+	inputLine func() int
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		ctx:                 context.Background(),
+		logger:              stdLogger{},
+		dialect:             PostgresDialect{},
+		progressInterval:    100000,
+		logEvery:            100000,
+		revisionColumn:      "revision",
+		smallBatchThreshold: 1000,
+		parallelism:         1,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithContext sets the context Upsert runs under, so the load can be
+// cancelled. The functions that take a context argument ignore it.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithRevisions bumps the revision column of every existing row the load
+// changes, and starts new rows at revision 1. A row only counts as changed if
+// one of its updated columns outside the key differs from the input, compared
+// with IS DISTINCT FROM, so reloading the same data leaves revisions alone.
+// WithRevisionColumn and WithRevisionStrategy change which column that is and
+// how it's bumped.
+func WithRevisions() Option {
+	return func(o *options) {
+		o.hasRevisions = true
+	}
+}
+
+// RevisionStrategy says how WithRevisions bumps the revision column.
+type RevisionStrategy int
+
+const (
+	// RevisionIncrement adds 1 to an integer revision, starting at 1.
+	RevisionIncrement RevisionStrategy = iota
+	// RevisionTimestamp sets a timestamp revision, such as a last_modified
+	// column, to the time of the load.
+	RevisionTimestamp
+)
+
+// WithRevisionColumn names the column WithRevisions bumps. Defaults to
+// "revision".
+func WithRevisionColumn(column string) Option {
+	return func(o *options) {
+		o.revisionColumn = column
+	}
+}
+
+// WithRevisionStrategy sets how WithRevisions bumps the revision column.
+// Defaults to RevisionIncrement.
+func WithRevisionStrategy(strategy RevisionStrategy) Option {
+	return func(o *options) {
+		o.revisionStrategy = strategy
+	}
+}
+
+// WithRevisionSavepoint runs the revision update behind a savepoint, so if it
+// fails the transaction is rolled back to before it, the failure is logged
+// and the upsert still goes ahead, leaving the revisions of matched rows as
+// they were. By default the revision update and the upsert are all or
+// nothing: a failure in either fails the load.
+func WithRevisionSavepoint() Option {
+	return func(o *options) {
+		o.revisionSavepoint = true
+	}
+}
+
+// WithLogger sends progress messages to l instead of the standard logger.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithNullSentinel sets the input value that gets loaded as NULL. Defaults to
+// "", so empty values become NULL.
+func WithNullSentinel(sentinel string) Option {
+	return func(o *options) {
+		o.nullSentinel = sentinel
+	}
+}
+
+// WithKeepEmptyStrings loads "" as an empty string rather than NULL, for
+// tables that need to tell the two apart. Note that "" is never a valid value
+// for numeric, date or boolean columns, so a blank field in one of those fails
+// the load; use WithNullSentinel with the value the input actually marks
+// missing values with (e.g. `\N`) instead.
+func WithKeepEmptyStrings() Option {
+	return func(o *options) {
+		o.keepEmptyStrings = true
+	}
+}
+
+// WithColumnMapping renames the loaded columns, mapping the names the input
+// rows are described by to the table's column names. Columns missing from
+// mapping are loaded under their own name. Every other column name given to
+// a load, such as the id columns, names a column of the table.
+func WithColumnMapping(mapping map[string]string) Option {
+	return func(o *options) {
+		o.columnMapping = mapping
+	}
+}
+
+// WithCaseInsensitiveColumns matches the id columns and loaded columns to
+// the table's columns ignoring case, e.g. an input's "PatientID" to a
+// patientid column, and uses the table's spelling in the SQL. A name that
+// matches a column exactly is kept as it is, and one matching several
+// columns that differ only in case fails the load with ErrColumnMismatch.
+// Column names given to other options must still be spelled like the
+// table's.
+func WithCaseInsensitiveColumns() Option {
+	return func(o *options) {
+		o.caseInsensitiveColumns = true
+	}
+}
+
+// WithColumnTypes gives the data types of some of the loaded columns, keyed
+// by column name, in place of the ones found on the table. Only JSON types
+// ("json" and "jsonb") currently change how values are loaded: they're passed
+// through verbatim, and only a blank value is loaded as NULL, whatever the
+// NULL sentinel is.
+func WithColumnTypes(types map[string]string) Option {
+	return func(o *options) {
+		o.columnTypes = types
+	}
+}
+
+// WithConverters parses the values of columns with custom funcs before
+// they're loaded, e.g. to turn "Y" and "N" into booleans or read a date in a
+// format Postgres doesn't know. converters maps a column, by its table name,
+// to a func taking the input value and returning the value to load, which
+// is handed to the driver as it is, like UpsertTyped's. Values loaded as
+// NULL and values that aren't strings are left alone. A func's error fails
+// the load, naming the row and column.
+func WithConverters(converters map[string]func(string) (interface{}, error)) Option {
+	return func(o *options) {
+		o.converters = converters
+	}
+}
+
+// WithRowFilter only loads the input rows keep returns true for, e.g. to
+// drop out-of-scope records without a separate filtering stage. The rest
+// are counted in RowsFiltered, and never reach the temp table, so they play
+// no part in revisions or deleting missing rows; with WithDeleteMissing a
+// filtered row counts as missing. keep sees each row's strings after
+// WithRowTransformer, but before empty strings become NULL and
+// WithConverters run, and mustn't keep or modify the slice. It only applies
+// to loads of strings, such as Upsert, UpsertContext, UpsertRows, UpsertTx
+// and UpsertCSV; UpsertTyped, UpsertItems and UpsertFromRows fail with it.
+// It's called from the goroutine running the load.
+func WithRowFilter(keep func(row []string) bool) Option {
+	return func(o *options) {
+		o.rowFilter = keep
+	}
+}
+
+// WithRowTransformer replaces each input row with what transform returns for
+// it, e.g. to trim values or uppercase codes in one place. transform gets the
+// row's strings as they were read, before empty strings become NULL and
+// WithConverters run, and may modify them in place. The row it returns must
+// still have a value per column, or the load fails. Like WithRowFilter, it
+// only applies to loads of strings. It's called from the goroutine running
+// the load.
+func WithRowTransformer(transform func(row []string) []string) Option {
+	return func(o *options) {
+		o.rowTransformer = transform
+	}
+}
+
+// WithCreateTable creates the table, if it doesn't exist yet, before
+// loading it, e.g. to bootstrap a new environment. types maps each column to
+// its SQL type, such as "text NOT NULL" or "bigint", and must cover every
+// loaded and id column; columns it has besides those, such as a revision
+// column, are created too. The key the upsert matches rows on becomes the
+// primary key: the id columns, or WithConflictColumns' columns if that's
+// given, which types must then cover too. The columns to load have to be
+// given, since there's no table yet to look them up on. types is trusted
+// SQL, used as it is.
+func WithCreateTable(types map[string]string) Option {
+	return func(o *options) {
+		o.createTable = types
+	}
+}
+
+// WithTempTable names the temp table rows are copied into. By default a name
+// is derived from the target table plus a random suffix, so concurrent loads
+// of the same table don't collide. Like those, name can't be schema-qualified.
+func WithTempTable(name string) Option {
+	return func(o *options) {
+		o.tempTable = name
+	}
+}
+
+// TempTableIncludes picks what the temp table copies from the table besides
+// its columns, which it always gets along with their NOT NULL constraints.
+type TempTableIncludes int
+
+const (
+	// IncludeDefaults copies column defaults, so columns missing from the
+	// input get the table's default, e.g. from a sequence, instead of NULL.
+	IncludeDefaults TempTableIncludes = 1 << iota
+	// IncludeConstraints copies CHECK constraints, so bad rows fail during
+	// the copy rather than the upsert. Every row copied is checked, which
+	// slows the copy down.
+	IncludeConstraints
+	// IncludeAll copies everything LIKE can, including indexes, each of
+	// which the copy then has to maintain.
+	IncludeAll TempTableIncludes = -1
+)
+
+// WithUniqueIndexName names the unique index built on the temp table, which
+// is otherwise named after the temp table with a "_key" suffix. It's created
+// with IF NOT EXISTS, so a reused staging table that kept its index from an
+// earlier load isn't indexed twice. It's ignored on MySQL, whose temp table
+// gets no index.
+func WithUniqueIndexName(name string) Option {
+	return func(o *options) {
+		o.uniqueIndexName = name
+	}
+}
+
+// WithTempTableIncludes creates the temp table with LIKE's INCLUDING options
+// for includes, e.g. IncludeDefaults|IncludeConstraints. By default only the
+// columns are copied.
+func WithTempTableIncludes(includes TempTableIncludes) Option {
+	return func(o *options) {
+		o.includes = includes
+	}
+}
+
+// WithSkipIndexCreation leaves out creating the unique index on the temp
+// table, for temp tables that already have one, e.g. a staging table reused
+// with WithTempTable. Without an index the upsert falls back to scanning the
+// temp table.
+func WithSkipIndexCreation() Option {
+	return func(o *options) {
+		o.skipIndex = true
+	}
+}
+
+// WithSkipAnalyze leaves out analyzing the temp table before the upsert.
+// That saves a pass over the temp table, which is worth it for small loads
+// where the planner picks a sensible plan anyway. Keep it for large loads:
+// without statistics the upsert's join against table can be planned badly.
+func WithSkipAnalyze() Option {
+	return func(o *options) {
+		o.skipAnalyze = true
+	}
+}
+
+// WithIgnoreAnalyzeErrors logs a failed ANALYZE of the temp table or of table
+// and carries on, instead of failing the load. ANALYZE only refreshes
+// statistics, so the rows are loaded either way.
+func WithIgnoreAnalyzeErrors() Option {
+	return func(o *options) {
+		o.ignoreAnalyze = true
+	}
+}
+
+// WithProgressFunc calls fn with the number of rows copied so far every
+// 100000 rows, or as often as WithProgressInterval says. fn is always called
+// from the goroutine running the load, even with WithParallelism.
+func WithProgressFunc(fn func(rowsProcessed int)) Option {
+	return func(o *options) {
+		o.progressFunc = fn
+	}
+}
+
+// WithProgressInterval sets how many rows pass between calls to the progress
+// func and metrics updates.
+func WithProgressInterval(rows int) Option {
+	return func(o *options) {
+		if rows > 0 {
+			o.progressInterval = rows
+		}
+	}
+}
+
+// WithLogEvery sets how many rows pass between the "Processed n rows..."
+// progress lines in the log. 0 leaves them out. Defaults to 100000.
+// Unlike WithProgressInterval, it doesn't affect the progress func.
+func WithLogEvery(rows int) Option {
+	return func(o *options) {
+		if rows >= 0 {
+			o.logEvery = rows
+		}
+	}
+}
+
+// WithCopyBatchSize commits the COPY into the temp table every rows rows and
+// starts a new one, so a huge input doesn't run as one giant transaction. The
+// upsert itself still runs once, after every row has been copied. Zero, the
+// default, never splits the COPY. With WithParallelism it applies to each
+// connection separately.
+func WithCopyBatchSize(rows int) Option {
+	return func(o *options) {
+		o.copyBatchSize = rows
+	}
+}
+
+// WithFlushEvery ends the COPY into the temp table every rows rows and starts
+// a new one in the same transaction, unlike WithCopyBatchSize, which commits
+// too. lib/pq already sends rows to the server whenever it has buffered 64KB
+// of them, and each Close only waits for the server to take in what was sent,
+// so this doesn't lower the memory a load holds on the client: the bulk
+// load's buffer stays at 64KB however many rows go through it. What it does
+// is make the server acknowledge the rows so far every rows rows, surfacing a
+// bad row or a dropped connection sooner. Zero, the default, never flushes.
+func WithFlushEvery(rows int) Option {
+	return func(o *options) {
+		o.flushEvery = rows
+	}
+}
+
+// WithAnalyzeTargetAfter runs ANALYZE on table once the upsert has
+// committed, on a connection of its own from the db given, so that the
+// planner's statistics take in the new rows before downstream queries run.
+// A failure fails the load with the "analyze" phase, though the upsert has
+// already committed by then, unless WithIgnoreAnalyzeErrors says otherwise.
+// It's off by default, but worth turning on for loads that change a good
+// part of table: ANALYZE only samples the table, so it's far cheaper than
+// VACUUM. UpsertTx ignores it.
+func WithAnalyzeTargetAfter() Option {
+	return func(o *options) {
+		o.analyzeTarget = true
+	}
+}
+
+// WithVacuumAfter runs VACUUM (ANALYZE) on table once the upsert has
+// committed, which also does what WithAnalyzeTargetAfter would, to clear out
+// the dead rows left by updates and deletes. It runs outside any transaction
+// on a connection of its own from the db given, and a failure fails the load
+// with the "vacuum" phase, though the upsert has already committed by then.
+// VACUUM reads the whole table and can run a long time on a big one, so it's
+// best kept for loads that rewrite a good part of table. UpsertTx ignores
+// it, and it isn't supported on MySQL.
+func WithVacuumAfter() Option {
+	return func(o *options) {
+		o.vacuumAfter = true
+	}
+}
+
+// WithSmallBatchThreshold sets how many rows a load can have and still skip
+// the temp table, being upserted with a single INSERT ... VALUES instead,
+// which saves the overhead of creating, indexing and analyzing the temp
+// table on small loads. The rows are read until there are more than rows of
+// them, and if there are, they're copied into the temp table as usual. A
+// small load is still retried with WithRetry, and duplicate keys among its
+// rows still fail it with ErrDuplicateKeys. 0 always uses the temp table.
+// Defaults to 1000.
+//
+// Only plain upserts on Postgres can skip the temp table, so it doesn't
+// apply with revisions, deleting missing rows, a watermark, MERGE,
+// TruncateLoad, UpdateOnly, WithDedupeKeepLast, WithRejectedRows,
+// WithParallelism, WithTempTable, WithTemplates, WithVacuumAfter,
+// WithValidateSQL, WithLockMode or WithRowCounts.
+func WithSmallBatchThreshold(rows int) Option {
+	return func(o *options) {
+		if rows >= 0 {
+			o.smallBatchThreshold = rows
+		}
+	}
+}
+
+// WithDeleteMissing deletes every row of the target table whose id isn't in
+// the input, in the same transaction as the upsert, so the table ends up
+// matching the input exactly. This is destructive: an empty input empties the
+// table.
+func WithDeleteMissing() Option {
+	return func(o *options) {
+		o.deleteMissing = true
+	}
+}
+
+// WithSoftDelete marks the rows of the table that are missing from the input
+// as deleted instead of removing them, by setting column, a timestamp column,
+// to now(). Rows already marked keep their original timestamp, and a marked
+// row that's loaded again has column cleared. column must not be one of the
+// loaded columns, and this can't be combined with WithDeleteMissing.
+func WithSoftDelete(column string) Option {
+	return func(o *options) {
+		o.softDeleteColumn = column
+	}
+}
+
+// AuditColumns names timestamp columns that a load keeps up to date itself.
+// Either may be empty. Neither may be one of the loaded columns.
+type AuditColumns struct {
+	// CreatedAtColumn is set to now() when a row is inserted, and left alone
+	// when it's updated.
+	CreatedAtColumn string
+	// UpdatedAtColumn is set to now() whenever a row is inserted or updated.
+	UpdatedAtColumn string
+}
+
+// WithAuditColumns has the upsert fill in the created and updated timestamps
+// in columns, so they don't need to be part of the input.
+func WithAuditColumns(columns AuditColumns) Option {
+	return func(o *options) {
+		o.auditColumns = columns
+	}
+}
+
+// WithConflictColumns detects conflicts with existing rows on columns, such
+// as a natural business key, instead of the id columns. The temp table's
+// unique index, the ON CONFLICT target and the matching of input rows to
+// table rows for revisions and deletes all use columns, while the id columns
+// only identify rows for WithChangedRows. columns must be loaded, and table
+// must have a unique index over exactly those columns.
+func WithConflictColumns(columns ...string) Option {
+	return func(o *options) {
+		o.conflictColumns = columns
+	}
+}
+
+// WithWatermark loads only the input rows whose column is past value, for
+// incremental syncs that keep a high-water mark such as a modification
+// timestamp or an increasing id. The rows at or below value are dropped from
+// the temp table before the upsert and counted in RowsBelowWatermark, and
+// the highest value of column among the rest is returned as the stats'
+// Watermark, to pass as value on the next run. A nil value, for the first
+// run, loads every row. column must be one of the loaded columns, and it
+// can't be combined with deleting missing rows or TruncateLoad, since the
+// rows it drops would count as missing.
+func WithWatermark(column string, value interface{}) Option {
+	return func(o *options) {
+		o.watermarkColumn = column
+		o.watermarkValue = value
+	}
+}
+
+// WithDedupeKeepLast drops every input row that a later row has the same key
+// as before the upsert, so the last row for each key wins instead of the
+// load failing on the duplicates. The dropped rows are counted in
+// RowsDuplicate. Rows are ordered by their place in the temp table, which is
+// the input order except with WithParallelism, where rows copied by
+// different workers have no set order. It's only supported on Postgres.
+func WithDedupeKeepLast() Option {
+	return func(o *options) {
+		o.dedupeKeepLast = true
+	}
+}
+
+// WithValidateSQL checks the copied rows before anything is written to the
+// table: query must return a single count of violations, and if it isn't
+// zero the load fails in the "validate" phase with ErrValidationFailed. It
+// runs in the upsert's transaction, and is executed as a template like the
+// SQL templates, so it can name the temp table as {{.TempTable}}, e.g.
+// "SELECT count(*) FROM {{.TempTable}} WHERE npi IS NULL". query is trusted
+// SQL.
+func WithValidateSQL(query string) Option {
+	return func(o *options) {
+		o.validateSQL = query
+	}
+}
+
+// WithUpdateWhere only updates an existing row on conflict if predicate
+// holds, e.g. "excluded.updated_at > claims.updated_at" to never overwrite a
+// row with older data. predicate is trusted SQL, inserted into the ON
+// CONFLICT DO UPDATE ... WHERE clause as it is; it can refer to the existing
+// row by the table's name and to the input row as excluded. Rows it leaves
+// alone aren't counted as updated. It's only supported on Postgres.
+func WithUpdateWhere(predicate string) Option {
+	return func(o *options) {
+		o.updateWhere = predicate
+	}
+}
+
+// WithExpectedVersionColumn guards against overwriting newer data, written
+// since the input was read, with an optimistic check on column, such as a
+// version number or a modification timestamp: each input row carries the
+// value it expects the existing row to have, and the existing row is only
+// updated while its value hasn't moved past that, or is NULL. The update
+// writes the input's value into column like any other. Rows left alone are
+// counted in RowsVersionConflict, or in RowsUnmatched with UpdateOnly.
+// column must be loaded, and can't be the revision column. It can't be
+// combined with WithMerge, and isn't supported on MySQL.
+func WithExpectedVersionColumn(column string) Option {
+	return func(o *options) {
+		o.expectedVersionColumn = column
+	}
+}
+
+// WithUpdateColumns limits which columns an existing row has overwritten on
+// conflict, e.g. to never touch created_at. New rows are still inserted with
+// every column. Each column must be one of the loaded columns.
+func WithUpdateColumns(columns ...string) Option {
+	return func(o *options) {
+		o.updateColumns = columns
+	}
+}
+
+// ConflictAction says what happens to an existing row that an input row
+// conflicts with.
+type ConflictAction int
+
+const (
+	// DoUpdate overwrites the existing row with the input row.
+	DoUpdate ConflictAction = iota
+	// DoNothing keeps the existing row as it is, so the load only inserts
+	// rows that are new to the table. Revisions are never bumped.
+	DoNothing
+)
+
+// WithConflictAction sets what happens on conflict with an existing row.
+// Defaults to DoUpdate.
+func WithConflictAction(action ConflictAction) Option {
+	return func(o *options) {
+		o.conflictAction = action
+	}
+}
+
+// LockMode says how the upsert transaction locks table before it changes
+// anything.
+type LockMode int
+
+const (
+	// LockNone takes no explicit lock, leaving the statements to take the
+	// row locks they need, so other sessions can keep writing to table.
+	LockNone LockMode = iota
+	// LockShareRowExclusive blocks other sessions from writing to table, but
+	// not from reading it.
+	LockShareRowExclusive
+	// LockExclusive blocks other sessions from writing to table, and from
+	// reading it other than with plain SELECTs.
+	LockExclusive
+	// LockAccessExclusive blocks every other use of table, even SELECTs.
+	LockAccessExclusive
+)
+
+// WithLockMode locks table at mode with LOCK TABLE at the start of the
+// upsert transaction, held until it commits, so that no other session
+// writes to table between the revisions being calculated and the rows being
+// upserted. Defaults to LockNone.
+//
+// Each mode conflicts with itself, so concurrent loads of the same table run
+// one after the other. A load waits for every open transaction that has
+// written to table to end first, and while it waits it blocks the sessions
+// queued behind it; set lock_timeout with WithSessionSettings to bound the
+// wait. A session that already holds a weaker lock on table and asks for a
+// stronger one can deadlock with this load, so with UpsertTx, whose
+// transaction keeps the lock until the caller ends it, lock before touching
+// table. With WithRetry, a load that deadlocks anyway is retried. It isn't
+// supported on MySQL.
+func WithLockMode(mode LockMode) Option {
+	return func(o *options) {
+		o.lockMode = mode
+	}
+}
+
+// MergeStrategy says how an existing row's column is updated from an input
+// row.
+type MergeStrategy int
+
+const (
+	// Replace overwrites the column with the input value.
+	Replace MergeStrategy = iota
+	// JSONBMerge merges the input jsonb document into the existing one with
+	// ||, so the input's top-level keys are added or replaced and the other
+	// existing keys are kept. A NULL on either side leaves the other side's
+	// document.
+	JSONBMerge
+	// ArrayAppend appends the input array to the existing one, keeping any
+	// elements they share twice. A NULL on either side leaves the other
+	// side's array.
+	ArrayAppend
+	// ArrayUnion appends the elements of the input array that aren't already
+	// in the existing one, dropping duplicates within either array too, and
+	// keeps their order otherwise. Like ArrayAppend, a NULL on either side
+	// leaves the other side's array. It's meant for one-dimensional arrays,
+	// as their elements are compared one by one.
+	ArrayUnion
+)
+
+// WithMergeStrategies sets how the update of an existing row treats the
+// listed columns, which must be updated columns; the others are replaced.
+// Each column's type is checked against its strategy once the table's
+// columns are looked up. Merge strategies aren't supported on MySQL.
+func WithMergeStrategies(strategies map[string]MergeStrategy) Option {
+	return func(o *options) {
+		o.mergeStrategies = strategies
+	}
+}
+
+// ChangedRow identifies a row a load inserted or updated.
+type ChangedRow struct {
+	// ID holds the row's key, one value per id column, in their text form.
+	ID []string
+	// Inserted is set if the row was new to the table.
+	Inserted bool
+	// Returned holds the values of WithReturnColumns' columns, such as an id
+	// the table generated on insert, in their text form.
+	Returned []string
+}
+
+// WithChangedRows sends the key of every row the upsert inserts or updates
+// to ch, e.g. to invalidate caches for just those rows. Rows left alone by
+// DoNothing aren't sent. The caller owns ch and should close it once the load
+// returns. With WithReturnColumns, each ChangedRow also carries the values of
+// those columns in Returned, while ID still holds just the key.
+//
+// Keys are sent while the upsert's transaction is open and before it's
+// committed, so they only count once the load returns without error, and a
+// retried upsert sends them again. The load waits on every send, so ch must
+// be read concurrently; collecting a very large change set into a slice
+// costs memory in proportion to the number of rows changed, so prefer to
+// handle the keys as they arrive.
+func WithChangedRows(ch chan<- ChangedRow) Option {
+	return func(o *options) {
+		o.changedRows = ch
+	}
+}
+
+// WithUnmatchedRows sends the key of every input row that matched no row of
+// the table to ch, one value per id column in their text form, e.g. to queue
+// them for a later insert. It needs UpdateOnly, and the keys are found with a
+// query of their own once the update has run. Rows that matched a row but
+// were left alone, e.g. by WithUpdateWhere, aren't sent, though they're
+// counted in RowsUnmatched. As with WithChangedRows, the caller owns ch, it
+// must be read concurrently, and the keys are sent before the transaction
+// commits.
+func WithUnmatchedRows(ch chan<- []string) Option {
+	return func(o *options) {
+		o.unmatchedRows = ch
+	}
+}
+
+// WithReturnColumns also sends the values of columns with each ChangedRow, as
+// the table holds them after the upsert, e.g. to map an identity or serial id
+// generated on insert back to the row's natural key, which must then be the
+// id columns and loaded with the rest. It needs WithChangedRows, and the
+// values are sent in each ChangedRow's Returned, in the order of columns,
+// with the rows themselves coming in no particular order. On Postgres the
+// values come from the upsert's RETURNING clause, so WithMerge falls back to
+// ON CONFLICT. It isn't supported on MySQL.
+func WithReturnColumns(columns ...string) Option {
+	return func(o *options) {
+		o.returnColumns = columns
+	}
+}
+
+// line returns the line of the input the last row read started on, or 0.
+func (o *options) line() int {
+	if o.inputLine == nil {
+		return 0
+	}
+	return o.inputLine()
+}
+
+// returnKey returns the columns the upsert returns for each changed row:
+// idColumns followed by WithReturnColumns' columns.
+func (o *options) returnKey(idColumns []string) []string {
+	return append(append([]string{}, idColumns...), o.returnColumns...)
+}
+
+// RejectedRow is an input row the temp table wouldn't take.
+type RejectedRow struct {
+	Row []interface{}
+	// Line is the line of the input the row started on for UpsertCSV, and 0
+	// for other loads.
+	Line int
+	Err  error
+}
+
+// WithRejectedRows sends the rows the database rejects during the copy to
+// ch, along with the error, and loads the rest instead of failing the load.
+// The caller owns ch and should close it once the load returns, and the load
+// waits on every send, so ch must be read concurrently.
+//
+// A bulk load can't carry on after a bad row, so rows are committed to the
+// temp table in batches, of WithCopyBatchSize rows or 10000 by default, and
+// each batch is kept in memory until it's committed. When one fails, it's
+// rolled back and loaded again one row at a time, each behind a savepoint,
+// which is far slower. UpsertTx ignores this option.
+func WithRejectedRows(ch chan<- RejectedRow) Option {
+	return func(o *options) {
+		o.rejectedRows = ch
+	}
+}
+
+// LoadMode says how the input replaces the table's contents.
+type LoadMode int
+
+const (
+	// LoadUpsert inserts new rows and updates existing ones.
+	LoadUpsert LoadMode = iota
+	// TruncateLoad empties the table and inserts every input row, for
+	// loading full snapshots. The table is emptied in the same transaction
+	// as the insert, so other sessions never see it empty; they wait for the
+	// load to commit instead, because of the lock the truncate takes. There's
+	// no conflict handling, and revisions and deleting missing rows can't be
+	// used.
+	TruncateLoad
+	// UpdateOnly updates the rows of the table that match an input row and
+	// never inserts, for enriching rows that must already exist. Input rows
+	// without a match are counted in RowsUnmatched. With revisions, only the
+	// matched rows get a new revision. WithMerge is ignored, and DoNothing
+	// can't be used.
+	UpdateOnly
+)
+
+// WithLoadMode sets how the input replaces the table's contents. Defaults
+// to LoadUpsert.
+func WithLoadMode(mode LoadMode) Option {
+	return func(o *options) {
+		o.loadMode = mode
+	}
+}
+
+// WithTruncateCascade has TruncateLoad also truncate every table with a
+// foreign key to the table, and any tables referencing those in turn. That
+// empties tables the load never refills, so it has to be asked for. It only
+// applies on Postgres.
+func WithTruncateCascade() Option {
+	return func(o *options) {
+		o.truncateCascade = true
+	}
+}
+
+// WithMerge upserts with MERGE instead of INSERT ... ON CONFLICT when the
+// server is Postgres 15 or later, falling back to ON CONFLICT on older
+// servers. MERGE can be faster for loads that mostly update. It can't be
+// combined with WithUpdateWhere, and isn't supported on MySQL.
+func WithMerge() Option {
+	return func(o *options) {
+		o.useMerge = true
+	}
+}
+
+// WithDialect picks the database being loaded into. Defaults to
+// PostgresDialect.
+func WithDialect(d Dialect) Option {
+	return func(o *options) {
+		o.dialect = d
+	}
+}
+
+// WithTemplates executes the SQL templates in fsys, such as
+// upsert.sql.template, instead of the dialect's own, e.g. to have the upsert
+// call a stored procedure. fsys replaces the dialect's templates as a whole,
+// so it has to hold every template the load needs, see Dialect's Templates;
+// a load fails before touching the database if one is missing. The
+// dialect's templates in the sql directory are a good starting point, and
+// show the data the templates are executed with.
+func WithTemplates(fsys fs.FS) Option {
+	return func(o *options) {
+		o.templates = fsys
+	}
+}
+
+// WithMetrics tells m about rows copied, load durations and failed loads.
+func WithMetrics(m MetricsObserver) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithOnSuccess calls fn with the load's stats once it has committed and
+// finished, e.g. to start downstream work. It runs exactly once for a
+// successful load, just before it returns, and never for a failed one. If fn
+// returns an error, the load returns it in the "on success" phase, with the
+// stats; the upsert stays committed. UpsertTx ignores it, as the caller
+// commits.
+func WithOnSuccess(fn func(stats UpsertStats) error) Option {
+	return func(o *options) {
+		o.onSuccess = fn
+	}
+}
+
+// WithDebugSQL sets UpsertStats.Statements to the SQL the load runs, with
+// the temp table it picked, to reproduce a failure by hand. It only holds the
+// statements' text: rows are sent separately from the SQL, so no values are
+// included. A load small enough to skip the temp table only has Upsert set.
+func WithDebugSQL() Option {
+	return func(o *options) {
+		o.debugSQL = true
+	}
+}
+
+// WithRowCounts counts the rows of table at the start and at the end of the
+// upsert transaction into UpsertStats.RowsBefore and RowsAfter, as a sanity
+// check of how much a load changed it. The second count sees the load's own
+// changes before they commit, so only other sessions' commits in between
+// can skew it; with WithLockMode, or at REPEATABLE READ, RowsDelta is
+// exactly the rows inserted less those deleted. Counting reads the whole
+// table, which takes a while on a big one, so it's off by default.
+func WithRowCounts() Option {
+	return func(o *options) {
+		o.rowCounts = true
+	}
+}
+
+// WithTracer starts a span around each phase of a load with t. The spans are
+// children of any span in the context the load is given.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// sessionSettings are the settings WithSessionSettings can change. Only
+// listed names are accepted, since they're put into SET statements as they
+// are.
+var sessionSettings = []string{
+	"work_mem",
+	"maintenance_work_mem",
+	"synchronous_commit",
+	"max_parallel_maintenance_workers",
+	"max_parallel_workers_per_gather",
+	"lock_timeout",
+	"jit",
+}
+
+// WithSessionSettings applies Postgres settings to each transaction of the
+// load with SET LOCAL, so they never leak into other uses of the connection.
+// The accepted settings are work_mem, which helps the joins and sorts of the
+// upsert and revisions; maintenance_work_mem and
+// max_parallel_maintenance_workers, for building the temp table's index;
+// synchronous_commit, which "off" speeds up committing the copy and upsert
+// at the risk of losing the last transactions in a crash; and
+// max_parallel_workers_per_gather, lock_timeout and jit. Values are quoted,
+// so they're always taken literally. Any other setting fails the load before
+// it starts. With UpsertTx the settings last until txn ends.
+func WithSessionSettings(settings map[string]string) Option {
+	return func(o *options) {
+		o.sessionSettings = settings
+	}
+}
+
+// WithRetry retries the upsert after a serialization failure or deadlock as
+// policy allows. By default it isn't retried.
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = policy
+	}
+}
+
+// WithLoadRetries starts the whole load over, with a fresh temp table and a
+// fresh copy, as policy allows if it fails because the connection to the
+// database was lost, e.g. the TCP connection dropped mid-copy. Since a
+// channel of rows can only be read once, only loads whose rows can be read
+// again are retried: UpsertRows, and UpsertCSV when r is an io.Seeker such
+// as an *os.File, which is seeked back to where it was. Other loads ignore
+// it. The stats returned are those of the last attempt.
+func WithLoadRetries(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.loadRetry = policy
+	}
+}
+
+// StagingTableMode says what kind of table the rows are copied into before
+// the upsert.
+type StagingTableMode int
+
+const (
+	// StagingTemp copies into a temp table, which only the load's own
+	// connection can see and which the server drops if the session dies.
+	StagingTemp StagingTableMode = iota
+	// StagingUnlogged copies into an UNLOGGED regular table with a random
+	// name, on MySQL a plain table, which is dropped at the end of the load
+	// whether it succeeds or not, unless WithKeepStagingOnError says
+	// otherwise. Like a temp table it skips the WAL, so it's emptied if the
+	// server crashes, and since any connection can see it, WithParallelism
+	// can copy into it from several workers. If the process dies mid-load
+	// though, the table is left behind and has to be dropped by hand.
+	StagingUnlogged
+)
+
+// WithStagingTableMode picks the kind of table the rows are copied into.
+// Defaults to StagingTemp, except with WithParallelism above 1, which always
+// uses StagingUnlogged.
+func WithStagingTableMode(mode StagingTableMode) Option {
+	return func(o *options) {
+		o.stagingMode = mode
+	}
+}
+
+// WithStagingTablespace creates the temp or staging table in tablespace,
+// e.g. one on fast scratch storage for big loads. The load fails in the
+// "create temp table" phase, saying so, if the tablespace doesn't exist.
+// It isn't supported on MySQL.
+func WithStagingTablespace(tablespace string) Option {
+	return func(o *options) {
+		o.stagingTablespace = tablespace
+	}
+}
+
+// WithKeepStagingOnError leaves the staging table in place when a load
+// fails, logging its name, so the rows that were copied can be inspected.
+// It's then up to the operator to drop it. It only applies to the regular
+// table of StagingUnlogged, or WithParallelism above 1: a temp table still
+// goes away with its session, and UpsertTx's staging table with a rolled
+// back transaction.
+func WithKeepStagingOnError() Option {
+	return func(o *options) {
+		o.keepStagingOnError = true
+	}
+}
+
+// useStaging reports whether the load copies into a staging table rather
+// than a temp table.
+func (opts *options) useStaging() bool {
+	return opts.parallelism > 1 || opts.stagingMode == StagingUnlogged
+}
+
+// WithParallelism copies rows over n connections at once. Above 1, the rows
+// go into an UNLOGGED staging table instead of a temp table, since temp
+// tables can't be shared between connections; see StagingUnlogged. A load
+// then holds n+1 connections from the pool, so db's SetMaxOpenConns must
+// allow at least that many or the load will hang. Defaults to 1.
+func WithParallelism(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.parallelism = n
+		}
+	}
+}
+
+// WithIsolationLevel runs both the copy and the upsert transactions at level
+// instead of the driver's default. SERIALIZABLE loads that run concurrently
+// with other writers should also use WithRetry, since serialization failures
+// are then expected.
+func WithIsolationLevel(level sql.IsolationLevel) Option {
+	return func(o *options) {
+		o.isolationLevel = level
+	}
+}
+
+// WithStatementTimeout has the database abort any statement of the load that
+// runs longer than d, e.g. one stuck waiting on a lock, which a context
+// deadline can't see from the client. On Postgres each transaction starts
+// with SET LOCAL statement_timeout; with UpsertTx that's the caller's
+// transaction, which keeps the timeout until it ends. It isn't supported on
+// MySQL.
+func WithStatementTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.statementTimeout = d
+	}
+}
+
+// RetryPolicy says how often, and how soon, something that failed is tried
+// again. With WithRetry, it governs the transaction that upserts the temp
+// table into the target, which is only retried after a Postgres
+// serialization failure (40001) or deadlock (40P01), without copying the rows
+// again. With WithLoadRetries, it governs the whole load, which is only
+// retried after losing the connection, and copies every row again.
+type RetryPolicy struct {
+	// MaxAttempts is the most times the upsert or the load is tried,
+	// including the first. Values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry. It doubles before
+	// each one after that.
+	Backoff time.Duration
+}
+
+func (opts *options) txOptions() *sql.TxOptions {
+	if opts.isolationLevel == sql.LevelDefault {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: opts.isolationLevel}
+}
+
+// mapColumns returns the table's names for the loaded columns.
+func (opts *options) mapColumns(columns []string) []string {
+	if len(opts.columnMapping) == 0 {
+		return columns
+	}
+	mapped := make([]string, len(columns))
+	for i, column := range columns {
+		if target, ok := opts.columnMapping[column]; ok {
+			mapped[i] = target
+		} else {
+			mapped[i] = column
+		}
+	}
+	return mapped
+}
+
+// conflictKey returns the columns conflicts are detected on, followed by
+// any of the partition key found by addPartitionKey they don't include.
+func (opts *options) conflictKey(idColumns []string) []string {
+	key := idColumns
+	if len(opts.conflictColumns) > 0 {
+		key = opts.conflictColumns
+	}
+	if len(opts.partitionKey) == 0 {
+		return key
+	}
+	key = append([]string{}, key...)
+	for _, column := range opts.partitionKey {
+		if !contains(key, column) {
+			key = append(key, column)
+		}
+	}
+	return key
+}
+
+// matchKey returns the columns the upsert matches input rows to table rows
+// on, which are none when the table is truncated first.
+func (opts *options) matchKey(idColumns []string) []string {
+	if opts.loadMode == TruncateLoad {
+		return nil
+	}
+	return opts.conflictKey(idColumns)
+}
+
+// sqlTemplates returns the SQL templates for the load, which are the
+// dialect's unless WithTemplates was given.
+func (opts *options) sqlTemplates() fs.FS {
+	if opts.templates != nil {
+		return opts.templates
+	}
+	return opts.dialect.Templates()
+}
+
+// setColumnTypes records which of the loaded columns hold JSON, given the
+// data type of each column.
+func (opts *options) setColumnTypes(columns []string, types map[string]string) {
+	opts.json = make([]bool, len(columns))
+	for i, column := range columns {
+		dataType := strings.ToLower(types[column])
+		opts.json[i] = dataType == "json" || dataType == "jsonb"
+	}
+}
+
+// convertNulls replaces the string values in row that should be loaded as
+// NULL with nil. A JSON value is only NULL if it's blank, so JSON is never
+// mistaken for the NULL sentinel.
+func (opts *options) convertNulls(row []interface{}) {
+	for i, value := range row {
+		s, isString := value.(string)
+		if !isString {
+			continue
+		}
+		if i < len(opts.json) && opts.json[i] {
+			if strings.TrimSpace(s) == "" {
+				row[i] = nil
+			}
+		} else if opts.isNull(s) {
+			row[i] = nil
+		}
+	}
+}
+
+// isNull reports whether an input value should be loaded as NULL.
+func (opts *options) isNull(value string) bool {
+	if value == "" && opts.keepEmptyStrings {
+		return false
+	}
+	return value == opts.nullSentinel
+}
@@ -0,0 +1,1001 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// The tests in this file load into the Postgres database at
+// BLOOMDB_TEST_DSN, and are skipped if it isn't set, e.g.
+//
+//	BLOOMDB_TEST_DSN=postgres://localhost/bloomdb_test?sslmode=disable go test .
+//
+// Each test creates the tables it needs, named bloomdb_test_*, and drops
+// them when it's done.
+
+// testDB returns the database at BLOOMDB_TEST_DSN, skipping t without one.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("BLOOMDB_TEST_DSN")
+	if dsn == "" {
+		t.Skip("BLOOMDB_TEST_DSN isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testTable creates table with the column definitions in columns, dropping
+// it once t is done.
+func testTable(t *testing.T, db *sql.DB, table string, columns string) {
+	t.Helper()
+	mustExec(t, db, "DROP TABLE IF EXISTS "+table+" CASCADE")
+	mustExec(t, db, "CREATE TABLE "+table+" ("+columns+")")
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS " + table + " CASCADE") })
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func queryInt(t *testing.T, db *sql.DB, query string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// tempTablesLeft counts the temp and staging tables of loads into table
+// that weren't dropped, in any session.
+func tempTablesLeft(t *testing.T, db *sql.DB, table string) int64 {
+	t.Helper()
+	prefix := strings.Replace(table, ".", "_", -1) + "_temp_"
+	return queryInt(t, db, "SELECT count(*) FROM pg_class WHERE relkind = 'r' AND left(relname, length($1)) = $1", prefix)
+}
+
+// load upserts rows into table, failing t if the load does.
+func load(t *testing.T, db *sql.DB, table string, idColumns []string, columns []string, rows [][]string, opts ...Option) UpsertStats {
+	t.Helper()
+	stats, err := loadErr(db, table, idColumns, columns, rows, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func loadErr(db *sql.DB, table string, idColumns []string, columns []string, rows [][]string, opts ...Option) (UpsertStats, error) {
+	opts = append([]Option{WithLogger(discardLogger{})}, opts...)
+	return UpsertContext(context.Background(), db, table, idColumns, columns, rowsOf(rows...), opts...)
+}
+
+// bothPaths are the options for loading through a temp table, and for
+// loading a small input straight into the table.
+var bothPaths = []struct {
+	name string
+	opts []Option
+}{
+	{"temp table", []Option{WithSmallBatchThreshold(0)}},
+	{"small batch", nil},
+}
+
+func TestPostgresRollsBackFailedRevisions(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_rollback"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int, revision int")
+
+	// The temp table has no such column, so the revision update fails.
+	_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(10),
+		WithRevisions(), WithRevisionColumn("missing"))
+	var upsertErr *UpsertError
+	if !errors.As(err, &upsertErr) || upsertErr.Phase != "revisions" {
+		t.Fatalf("got %v, want a revisions phase error", err)
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		t.Errorf("got %v, want it to wrap the *pq.Error", err)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 0 {
+		t.Errorf("got %d rows, want the failed load rolled back", n)
+	}
+	if n := tempTablesLeft(t, db, table); n != 0 {
+		t.Errorf("%d temp tables were left behind", n)
+	}
+}
+
+func TestPostgresCancelledMidCopy(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_cancel"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rows := make(chan []string)
+	go func() {
+		defer close(rows)
+		for _, row := range numberedRows(2000) {
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stats, err := UpsertContext(ctx, db, table, []string{"id"}, []string{"id", "amount"}, rows,
+		WithLogger(discardLogger{}), WithProgressInterval(500), WithProgressFunc(func(rowsProcessed int) {
+			if rowsProcessed == 500 {
+				cancel()
+			}
+		}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if stats.RowsCopied != 500 {
+		t.Errorf("got %d rows copied, want 500", stats.RowsCopied)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 0 {
+		t.Errorf("got %d rows, want none", n)
+	}
+	if n := tempTablesLeft(t, db, table); n != 0 {
+		t.Errorf("%d temp tables were left behind", n)
+	}
+}
+
+func TestPostgresCompositeKey(t *testing.T) {
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_composite"
+			testTable(t, db, table, "a int NOT NULL, b int, amount int, UNIQUE (a, b)")
+			columns := []string{"a", "b", "amount"}
+
+			load(t, db, table, []string{"a", "b"}, columns, [][]string{{"1", "1", "10"}, {"1", "2", "20"}, {"1", "", "30"}}, path.opts...)
+			stats := load(t, db, table, []string{"a", "b"}, columns, [][]string{{"1", "1", "11"}, {"2", "1", "40"}, {"1", "", "31"}}, path.opts...)
+
+			// A NULL key part never matches, so (1, NULL) is inserted again.
+			if stats.RowsInserted != 2 || stats.RowsUpdated != 1 {
+				t.Errorf("got %d rows inserted and %d updated, want 2 and 1", stats.RowsInserted, stats.RowsUpdated)
+			}
+			if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE a = 1 AND b = 1"); n != 11 {
+				t.Errorf("got amount %d for (1, 1), want 11", n)
+			}
+			if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE a = 1 AND b = 2"); n != 20 {
+				t.Errorf("got amount %d for (1, 2), want it untouched at 20", n)
+			}
+			if n := queryInt(t, db, "SELECT count(*) FROM "+table+" WHERE b IS NULL"); n != 2 {
+				t.Errorf("got %d rows with a NULL b, want 2", n)
+			}
+		})
+	}
+}
+
+func TestPostgresConcurrentLoads(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_concurrent"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	rows := numberedRows(2000)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 2)
+	for _, half := range [][][]string{rows[:1000], rows[1000:]} {
+		wg.Add(1)
+		go func(half [][]string) {
+			defer wg.Done()
+			_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, half, WithSmallBatchThreshold(0))
+			errs <- err
+		}(half)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 2000 {
+		t.Errorf("got %d rows, want 2000", n)
+	}
+}
+
+func TestPostgresQuotedIdentifiers(t *testing.T) {
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_quoted"
+			testTable(t, db, table, `"ID" int PRIMARY KEY, "select" text, "Amount" int`)
+
+			columns := []string{"ID", "select", "Amount"}
+			load(t, db, table, []string{"ID"}, columns, [][]string{{"1", "from", "10"}}, path.opts...)
+			load(t, db, table, []string{"ID"}, columns, [][]string{{"1", "where", "20"}}, path.opts...)
+
+			var selected string
+			var amount int
+			if err := db.QueryRow(`SELECT "select", "Amount" FROM `+table+` WHERE "ID" = 1`).Scan(&selected, &amount); err != nil {
+				t.Fatal(err)
+			}
+			if selected != "where" || amount != 20 {
+				t.Errorf("got %q and %d, want where and 20", selected, amount)
+			}
+		})
+	}
+}
+
+func TestPostgresSchemaQualified(t *testing.T) {
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			db := testDB(t)
+			mustExec(t, db, "CREATE SCHEMA IF NOT EXISTS bloomdb_test_reporting")
+			t.Cleanup(func() { db.Exec("DROP SCHEMA IF EXISTS bloomdb_test_reporting CASCADE") })
+			table := "bloomdb_test_reporting.claims"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+			load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(10), path.opts...)
+			stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(12), path.opts...)
+			if stats.RowsInserted != 2 || stats.RowsUpdated != 10 {
+				t.Errorf("got %d rows inserted and %d updated, want 2 and 10", stats.RowsInserted, stats.RowsUpdated)
+			}
+			if n := tempTablesLeft(t, db, table); n != 0 {
+				t.Errorf("%d temp tables were left behind", n)
+			}
+		})
+	}
+}
+
+func TestPostgresAuditColumns(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_audit"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int, created_at timestamptz, updated_at timestamptz")
+	audit := WithAuditColumns(AuditColumns{CreatedAtColumn: "created_at", UpdatedAtColumn: "updated_at"})
+
+	load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "10"}}, audit)
+	var created, updated time.Time
+	if err := db.QueryRow("SELECT created_at, updated_at FROM "+table+" WHERE id = 1").Scan(&created, &updated); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "20"}}, audit)
+	var created2, updated2 time.Time
+	if err := db.QueryRow("SELECT created_at, updated_at FROM "+table+" WHERE id = 1").Scan(&created2, &updated2); err != nil {
+		t.Fatal(err)
+	}
+	if !created2.Equal(created) {
+		t.Errorf("created_at went from %v to %v, want it kept", created, created2)
+	}
+	if !updated2.After(updated) {
+		t.Errorf("updated_at went from %v to %v, want it advanced", updated, updated2)
+	}
+}
+
+func TestPostgresExistingIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"copied index", []Option{WithTempTableIncludes(IncludeAll)}},
+		{"copied index, skipping ours", []Option{WithTempTableIncludes(IncludeAll), WithSkipIndexCreation()}},
+		{"no index", []Option{WithSkipIndexCreation()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_index"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int")
+			opts := append([]Option{WithSmallBatchThreshold(0)}, test.opts...)
+			load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(10), opts...)
+		})
+	}
+}
+
+func TestPostgresReusedStagingTable(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_staging"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	opts := []Option{
+		WithStagingTableMode(StagingUnlogged),
+		WithTempTable("bloomdb_test_staging_reused"),
+		WithUniqueIndexName("bloomdb_test_staging_reused_key"),
+	}
+
+	for i := 0; i < 2; i++ {
+		load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(10), opts...)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM pg_class WHERE relname LIKE 'bloomdb_test_staging_reused%'"); n != 0 {
+		t.Errorf("%d staging tables or indexes were left behind", n)
+	}
+}
+
+func TestPostgresStagingDropped(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  [][]string
+		fails bool
+	}{
+		{"success", [][]string{{"1", "10"}}, false},
+		// The staging table doesn't copy the CHECK, so the upsert fails.
+		{"failure", [][]string{{"1", "-10"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_unlogged"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int CHECK (amount >= 0)")
+
+			_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, test.rows, WithStagingTableMode(StagingUnlogged))
+			if (err != nil) != test.fails {
+				t.Fatalf("got %v, want failure %v", err, test.fails)
+			}
+			if n := tempTablesLeft(t, db, table); n != 0 {
+				t.Errorf("%d staging tables were left behind", n)
+			}
+		})
+	}
+}
+
+func TestPostgresKeepStagingOnError(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_kept"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int CHECK (amount >= 0)")
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS bloomdb_test_kept_staging") })
+
+	_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "-10"}},
+		WithStagingTableMode(StagingUnlogged), WithKeepStagingOnError(), WithTempTable("bloomdb_test_kept_staging"))
+	if err == nil {
+		t.Fatal("the CHECK violation was accepted")
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM bloomdb_test_kept_staging"); n != 1 {
+		t.Errorf("the kept staging table has %d rows, want the 1 loaded", n)
+	}
+}
+
+func TestPostgresJSONB(t *testing.T) {
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_jsonb"
+			testTable(t, db, table, "id int PRIMARY KEY, doc jsonb")
+
+			load(t, db, table, []string{"id"}, []string{"id", "doc"}, [][]string{{"1", "{}"}, {"2", "null"}, {"3", ""}, {"4", `{"a": [1, ""]}`}}, path.opts...)
+
+			want := map[int]sql.NullString{
+				1: {String: "{}", Valid: true},
+				2: {String: "null", Valid: true},
+				3: {},
+				4: {String: `{"a": [1, ""]}`, Valid: true},
+			}
+			for id, doc := range want {
+				var got sql.NullString
+				if err := db.QueryRow("SELECT doc::text FROM "+table+" WHERE id = $1", id).Scan(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got != doc {
+					t.Errorf("got %+v for row %d, want %+v", got, id, doc)
+				}
+			}
+		})
+	}
+}
+
+func TestPostgresTextArrays(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_arrays"
+	testTable(t, db, table, "id int PRIMARY KEY, tags text[]")
+
+	want := map[int64][]string{
+		1: {"a,b", `c"d`, "{e}", ""},
+		2: {},
+	}
+	rows := make(chan []interface{}, len(want))
+	for id, tags := range want {
+		rows <- []interface{}{id, tags}
+	}
+	close(rows)
+	_, err := UpsertTyped(context.Background(), db, table, []string{"id"}, []string{"id", "tags"}, rows, WithLogger(discardLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, tags := range want {
+		var got pq.StringArray
+		if err := db.QueryRow("SELECT tags FROM "+table+" WHERE id = $1 AND tags IS NOT NULL", id).Scan(&got); err != nil {
+			t.Fatalf("row %d: %v", id, err)
+		}
+		if !reflect.DeepEqual([]string(got), tags) {
+			t.Errorf("got %q for row %d, want %q", got, id, tags)
+		}
+	}
+}
+
+func TestPostgresUpdateWhere(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_where"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int, version int")
+	mustExec(t, db, "INSERT INTO "+table+" VALUES (1, 10, 5), (2, 20, 5)")
+
+	columns := []string{"id", "amount", "version"}
+	stats := load(t, db, table, []string{"id"}, columns, [][]string{{"1", "11", "4"}, {"2", "21", "6"}},
+		WithUpdateWhere("excluded.version > "+table+".version"))
+	if stats.RowsUpdated != 1 {
+		t.Errorf("got %d rows updated, want 1", stats.RowsUpdated)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 1"); n != 10 {
+		t.Errorf("the older row 1 clobbered the newer one, amount is %d", n)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 2"); n != 21 {
+		t.Errorf("the newer row 2 wasn't applied, amount is %d", n)
+	}
+}
+
+func TestPostgresExpectedVersion(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_version"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int, version int")
+	mustExec(t, db, "INSERT INTO "+table+" VALUES (1, 10, 1), (2, 20, 1)")
+
+	// Someone else bumps row 1 while our load with version 1 is underway.
+	mustExec(t, db, "UPDATE "+table+" SET amount = 15, version = 2 WHERE id = 1")
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount", "version"}, [][]string{{"1", "11", "1"}, {"2", "21", "1"}},
+		WithExpectedVersionColumn("version"))
+	if stats.RowsUpdated != 1 || stats.RowsVersionConflict != 1 {
+		t.Errorf("got %d rows updated and %d conflicts, want 1 and 1", stats.RowsUpdated, stats.RowsVersionConflict)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 1"); n != 15 {
+		t.Errorf("the concurrent bump was overwritten, amount is %d", n)
+	}
+}
+
+func TestPostgresNoKey(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_nokey"
+	testTable(t, db, table, "id int, amount int")
+
+	for i := 0; i < 2; i++ {
+		stats := load(t, db, table, nil, []string{"id", "amount"}, numberedRows(1000))
+		if stats.RowsInserted != 1000 {
+			t.Errorf("got %d rows inserted, want 1000", stats.RowsInserted)
+		}
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 2000 {
+		t.Errorf("got %d rows, want every row of both loads", n)
+	}
+}
+
+func TestPostgresMerge(t *testing.T) {
+	db := testDB(t)
+	if version := queryInt(t, db, "SHOW server_version_num"); version < 150000 {
+		t.Skipf("server version %d has no MERGE", version)
+	}
+	table := "bloomdb_test_merge"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	mustExec(t, db, "INSERT INTO "+table+" VALUES (1, 10)")
+
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "11"}, {"2", "20"}}, WithMerge())
+	if stats.RowsInserted != 1 || stats.RowsUpdated != 1 {
+		t.Errorf("got %d rows inserted and %d updated, want 1 and 1", stats.RowsInserted, stats.RowsUpdated)
+	}
+	if n := queryInt(t, db, "SELECT sum(amount) FROM "+table); n != 31 {
+		t.Errorf("got a total of %d, want 31", n)
+	}
+}
+
+func TestPostgresPartitioned(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_parted"
+	mustExec(t, db, "DROP TABLE IF EXISTS "+table+" CASCADE")
+	mustExec(t, db, "CREATE TABLE "+table+" (id int, created date, amount int, PRIMARY KEY (id, created)) PARTITION BY RANGE (created)")
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS " + table + " CASCADE") })
+	mustExec(t, db, "CREATE TABLE "+table+"_2024 PARTITION OF "+table+" FOR VALUES FROM ('2024-01-01') TO ('2025-01-01')")
+	mustExec(t, db, "CREATE TABLE "+table+"_2025 PARTITION OF "+table+" FOR VALUES FROM ('2025-01-01') TO ('2026-01-01')")
+
+	columns := []string{"id", "created", "amount"}
+	rows := [][]string{{"1", "2024-03-01", "10"}, {"2", "2025-03-01", "20"}}
+	load(t, db, table, []string{"id"}, columns, rows, WithSmallBatchThreshold(0))
+	stats := load(t, db, table, []string{"id"}, columns, rows, WithSmallBatchThreshold(0))
+	if stats.RowsInserted != 0 || stats.RowsUpdated != 2 {
+		t.Errorf("got %d rows inserted and %d updated, want 0 and 2", stats.RowsInserted, stats.RowsUpdated)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table+"_2025"); n != 1 {
+		t.Errorf("got %d rows in the 2025 partition, want 1", n)
+	}
+}
+
+func TestPostgresUpdateOnly(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_updateonly"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	mustExec(t, db, "INSERT INTO "+table+" VALUES (1, 10), (2, 20)")
+
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"2", "21"}, {"3", "30"}, {"4", "40"}},
+		WithLoadMode(UpdateOnly))
+	if stats.RowsInserted != 0 || stats.RowsUpdated != 1 || stats.RowsUnmatched != 2 {
+		t.Errorf("got %d inserted, %d updated and %d unmatched, want 0, 1 and 2", stats.RowsInserted, stats.RowsUpdated, stats.RowsUnmatched)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 2 {
+		t.Errorf("got %d rows, want no inserts", n)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 2"); n != 21 {
+		t.Errorf("got amount %d for row 2, want it updated to 21", n)
+	}
+}
+
+func TestPostgresUnmatchedRows(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_unmatched"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	mustExec(t, db, "INSERT INTO "+table+" VALUES (1, 10), (2, 20)")
+
+	unmatched := make(chan []string, 10)
+	load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"2", "21"}, {"3", "30"}, {"4", "40"}},
+		WithLoadMode(UpdateOnly), WithUnmatchedRows(unmatched))
+	close(unmatched)
+
+	var ids []string
+	for id := range unmatched {
+		ids = append(ids, id...)
+	}
+	if !reflect.DeepEqual(ids, []string{"3", "4"}) && !reflect.DeepEqual(ids, []string{"4", "3"}) {
+		t.Errorf("got unmatched ids %v, want 3 and 4", ids)
+	}
+}
+
+// revisionStrategies are the ways revisions can be kept: the column each
+// needs, the options selecting it and the column as text.
+var revisionStrategies = []struct {
+	name     string
+	column   string
+	opts     []Option
+	revision string
+}{
+	{"increment", "revision int", nil, "revision::text"},
+	{"timestamp", "modified timestamptz", []Option{WithRevisionColumn("modified"), WithRevisionStrategy(RevisionTimestamp)}, "modified::text"},
+}
+
+// revisions returns the revision of each row of table, as text.
+func revisions(t *testing.T, db *sql.DB, table string, revision string) map[int]string {
+	t.Helper()
+	got := map[int]string{}
+	rows, err := db.Query("SELECT id, " + revision + " FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var revision string
+		if err := rows.Scan(&id, &revision); err != nil {
+			t.Fatal(err)
+		}
+		got[id] = revision
+	}
+	return got
+}
+
+func TestPostgresRevisionStrategies(t *testing.T) {
+	for _, test := range revisionStrategies {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_revisions"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int, "+test.column)
+			opts := append([]Option{WithRevisions()}, test.opts...)
+
+			load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "10"}}, opts...)
+			first := revisions(t, db, table, test.revision)
+			if first[1] == "" {
+				t.Fatalf("got no revision for a new row")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "11"}}, opts...)
+			if got := revisions(t, db, table, test.revision); got[1] == first[1] {
+				t.Errorf("the updated row kept revision %s", got[1])
+			}
+			if stats.RevisionsUpdated != 1 {
+				t.Errorf("got %d revisions updated, want 1", stats.RevisionsUpdated)
+			}
+		})
+	}
+}
+
+func TestPostgresRevisionsOnlyChangedRows(t *testing.T) {
+	for _, test := range revisionStrategies {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_revisions"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int, doc jsonb, "+test.column)
+			opts := append([]Option{WithRevisions()}, test.opts...)
+			columns := []string{"id", "amount", "doc"}
+
+			load(t, db, table, []string{"id"}, columns, [][]string{{"1", "10", `{"a": 1}`}, {"2", "20", `{"b": 2}`}}, opts...)
+			first := revisions(t, db, table, test.revision)
+
+			// An identical load, with the JSON spelled differently, changes
+			// nothing.
+			time.Sleep(10 * time.Millisecond)
+			load(t, db, table, []string{"id"}, columns, [][]string{{"1", "10", `{"a":1}`}, {"2", "20", `{"b":2}`}}, opts...)
+			if got := revisions(t, db, table, test.revision); !reflect.DeepEqual(got, first) {
+				t.Errorf("an identical load moved revisions from %v to %v", first, got)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			stats := load(t, db, table, []string{"id"}, columns, [][]string{{"1", "10", `{"a": 1}`}, {"2", "21", `{"b": 2}`}}, opts...)
+			got := revisions(t, db, table, test.revision)
+			if got[1] != first[1] {
+				t.Errorf("unchanged row 1 went from revision %s to %s", first[1], got[1])
+			}
+			if got[2] == first[2] {
+				t.Errorf("changed row 2 kept revision %s", got[2])
+			}
+			if stats.RevisionsUpdated != 1 {
+				t.Errorf("got %d revisions updated, want 1", stats.RevisionsUpdated)
+			}
+		})
+	}
+}
+
+func TestPostgresRevisionSavepoint(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_savepoint"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int, revision int")
+
+	// The same templates, except for a revision update that always fails.
+	templates := fstest.MapFS{}
+	err := fs.WalkDir(PostgresDialect{}.Templates(), ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(PostgresDialect{}.Templates(), path)
+		templates[path] = &fstest.MapFile{Data: data}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates["updaterevisions.sql.template"] = &fstest.MapFile{Data: []byte("UPDATE {{.TempTable}} SET {{.RevisionColumn}} = 1 / 0")}
+
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(3),
+		WithRevisions(), WithRevisionSavepoint(), WithTemplates(templates))
+	if stats.RowsInserted != 3 {
+		t.Errorf("got %d rows inserted, want the upsert to carry on past the revisions", stats.RowsInserted)
+	}
+
+	_, err = loadErr(db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(3),
+		WithRevisions(), WithTemplates(templates))
+	var upsertErr *UpsertError
+	if !errors.As(err, &upsertErr) || upsertErr.Phase != "revisions" {
+		t.Errorf("got %v without the savepoint, want a revisions phase error", err)
+	}
+}
+
+// mergeStrategyTest loads value over a stored one with strategy, for a
+// value column of type column.
+type mergeStrategyTest struct {
+	name     string
+	column   string
+	strategy MergeStrategy
+	stored   string
+	loaded   string
+	want     string
+}
+
+func testMergeStrategies(t *testing.T, tests []mergeStrategyTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_strategies"
+			testTable(t, db, table, "id int PRIMARY KEY, value "+test.column)
+			stored := sql.NullString{String: test.stored, Valid: test.stored != ""}
+			mustExec(t, db, "INSERT INTO "+table+" VALUES (1, $1)", stored)
+
+			load(t, db, table, []string{"id"}, []string{"id", "value"}, [][]string{{"1", test.loaded}},
+				WithMergeStrategies(map[string]MergeStrategy{"value": test.strategy}))
+			var got string
+			if err := db.QueryRow("SELECT value::text FROM " + table).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPostgresMergeStrategies(t *testing.T) {
+	testMergeStrategies(t, []mergeStrategyTest{
+		{"jsonb merge", "jsonb", JSONBMerge, `{"a": 1, "b": 1}`, `{"b": 2, "c": 3}`, `{"a": 1, "b": 2, "c": 3}`},
+		{"jsonb merge into NULL", "jsonb", JSONBMerge, "", `{"b": 2}`, `{"b": 2}`},
+	})
+}
+
+func TestPostgresArrayMergeStrategies(t *testing.T) {
+	testMergeStrategies(t, []mergeStrategyTest{
+		{"array append", "int[]", ArrayAppend, "{1,2}", "{2,3}", "{1,2,2,3}"},
+		{"array append to NULL", "int[]", ArrayAppend, "", "{2,3}", "{2,3}"},
+		{"array union", "int[]", ArrayUnion, "{1,2}", "{2,3,3}", "{1,2,3}"},
+		{"array union with NULL", "int[]", ArrayUnion, "", "{2,3}", "{2,3}"},
+	})
+}
+
+func TestPostgresMergeStrategyType(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_strategy_type"
+	testTable(t, db, table, "id int PRIMARY KEY, value text")
+
+	_, err := loadErr(db, table, []string{"id"}, []string{"id", "value"}, [][]string{{"1", "x"}},
+		WithMergeStrategies(map[string]MergeStrategy{"value": JSONBMerge}))
+	if err == nil {
+		t.Error("a jsonb merge of a text column was accepted")
+	}
+}
+
+func TestPostgresValidate(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_validate"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "10"}, {"2", ""}, {"3", ""}},
+		WithValidateSQL("SELECT count(*) FROM {{.TempTable}} WHERE amount IS NULL"))
+	if !errors.Is(err, ErrValidationFailed) || !strings.Contains(err.Error(), "2 violations") {
+		t.Fatalf("got %v, want ErrValidationFailed with 2 violations", err)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 0 {
+		t.Errorf("got %d rows, want nothing committed", n)
+	}
+}
+
+func TestPostgresView(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_view_base"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	// Grouping keeps the view from being automatically updatable.
+	mustExec(t, db, "CREATE OR REPLACE VIEW bloomdb_test_view AS SELECT id, max(amount) AS amount FROM "+table+" GROUP BY id")
+	t.Cleanup(func() { db.Exec("DROP VIEW IF EXISTS bloomdb_test_view") })
+
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			_, err := loadErr(db, "bloomdb_test_view", []string{"id"}, []string{"id", "amount"}, numberedRows(3), path.opts...)
+			if err == nil || !strings.Contains(err.Error(), ".bloomdb_test_view is a view, not a table") {
+				t.Errorf("got %v, want it to say bloomdb_test_view is a view", err)
+			}
+		})
+	}
+
+	t.Run("UpsertTx", func(t *testing.T) {
+		txn, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer txn.Rollback()
+		_, err = UpsertTx(context.Background(), txn, "bloomdb_test_view", []string{"id"}, []string{"id", "amount"},
+			rowsOf(numberedRows(3)...), WithLogger(discardLogger{}))
+		if err == nil || !strings.Contains(err.Error(), ".bloomdb_test_view is a view, not a table") {
+			t.Errorf("got %v, want it to say bloomdb_test_view is a view", err)
+		}
+	})
+}
+
+func TestPostgresRowCounts(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_counts"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+	load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(5))
+
+	// Rows 4 and 5 are kept, 6 to 9 added and 1 to 3 deleted.
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(9)[3:],
+		WithRowCounts(), WithDeleteMissing())
+	if stats.RowsBefore != 5 || stats.RowsAfter != 6 {
+		t.Errorf("got %d rows before and %d after, want 5 and 6", stats.RowsBefore, stats.RowsAfter)
+	}
+	if stats.RowsDelta() != stats.RowsInserted-stats.RowsDeleted {
+		t.Errorf("got a delta of %d, want %d inserted less %d deleted", stats.RowsDelta(), stats.RowsInserted, stats.RowsDeleted)
+	}
+}
+
+func TestPostgresSmallBatchThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      int
+		tempTable bool
+	}{
+		{"at the threshold", 5, false},
+		{"over the threshold", 6, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_threshold"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+			stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(test.rows),
+				WithSmallBatchThreshold(5), WithDebugSQL())
+			if got := stats.Statements.TempTable != ""; got != test.tempTable {
+				t.Errorf("got temp table %v, want %v", got, test.tempTable)
+			}
+			if stats.RowsInserted != int64(test.rows) {
+				t.Errorf("got %d rows inserted, want %d", stats.RowsInserted, test.rows)
+			}
+			if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != int64(test.rows) {
+				t.Errorf("got %d rows, want %d", n, test.rows)
+			}
+		})
+	}
+}
+
+func TestPostgresDuplicateKeys(t *testing.T) {
+	rows := [][]string{{"1", "10"}, {"2", "20"}, {"1", "11"}}
+	for _, path := range bothPaths {
+		t.Run(path.name, func(t *testing.T) {
+			db := testDB(t)
+			table := "bloomdb_test_duplicates"
+			testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+			_, err := loadErr(db, table, []string{"id"}, []string{"id", "amount"}, rows, path.opts...)
+			if !errors.Is(err, ErrDuplicateKeys) || !strings.Contains(err.Error(), "id=1 (2 rows)") {
+				t.Errorf("got %v, want ErrDuplicateKeys listing id=1", err)
+			}
+		})
+	}
+}
+
+func TestPostgresDedupeKeepLast(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_dedupe"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, [][]string{{"1", "10"}, {"2", "20"}, {"1", "11"}}, WithDedupeKeepLast())
+	if stats.RowsDuplicate != 1 || stats.RowsInserted != 2 {
+		t.Errorf("got %d duplicates and %d rows inserted, want 1 and 2", stats.RowsDuplicate, stats.RowsInserted)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 1"); n != 11 {
+		t.Errorf("got amount %d for id 1, want the last row's 11", n)
+	}
+}
+
+func TestPostgresRejectedRows(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_rejected"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	rows := numberedRows(100)
+	rows[41][1] = "forty-two"
+	rows[76][1] = "seventy-seven"
+	rejected := make(chan RejectedRow, 10)
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, rows,
+		WithRejectedRows(rejected), WithCopyBatchSize(25))
+	close(rejected)
+
+	var ids []interface{}
+	for row := range rejected {
+		ids = append(ids, row.Row[0])
+		var pqErr *pq.Error
+		if !errors.As(row.Err, &pqErr) || pqErr.Code != "22P02" {
+			t.Errorf("got %v for row %v, want an invalid input error", row.Err, row.Row)
+		}
+	}
+	if !reflect.DeepEqual(ids, []interface{}{"42", "77"}) {
+		t.Errorf("got rejected rows %v, want 42 and 77", ids)
+	}
+	if stats.RowsRejected != 2 || stats.RowsInserted != 98 {
+		t.Errorf("got %d rows rejected and %d inserted, want 2 and 98", stats.RowsRejected, stats.RowsInserted)
+	}
+}
+
+func TestPostgresParallel(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_parallel"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	stats := load(t, db, table, []string{"id"}, []string{"id", "amount"}, numberedRows(10000), WithParallelism(4))
+	if stats.RowsCopied != 10000 || stats.RowsInserted != 10000 {
+		t.Errorf("got %d rows copied and %d inserted, want 10000", stats.RowsCopied, stats.RowsInserted)
+	}
+	if n := queryInt(t, db, "SELECT count(DISTINCT id) FROM "+table); n != 10000 {
+		t.Errorf("got %d rows, want 10000", n)
+	}
+	if n := tempTablesLeft(t, db, table); n != 0 {
+		t.Errorf("%d staging tables were left behind", n)
+	}
+}
+
+func TestPostgresUpsertTx(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_tx"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+	stats, err := UpsertTx(context.Background(), txn, table, []string{"id"}, []string{"id", "amount"},
+		rowsOf(numberedRows(10)...), WithLogger(discardLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsInserted != 10 {
+		t.Errorf("got %d rows inserted, want 10", stats.RowsInserted)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 0 {
+		t.Errorf("got %d rows visible before the commit, want none", n)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := queryInt(t, db, "SELECT count(*) FROM "+table); n != 10 {
+		t.Errorf("got %d rows after the commit, want 10", n)
+	}
+}
+
+func TestPostgresUpsertCSV(t *testing.T) {
+	db := testDB(t)
+	table := "bloomdb_test_csv"
+	testTable(t, db, table, "id int PRIMARY KEY, amount int")
+
+	var b strings.Builder
+	b.WriteString("id,amount\n")
+	for _, row := range numberedRows(2000) {
+		b.WriteString(row[0] + "," + row[1] + "\n")
+	}
+	stats, err := UpsertCSV(context.Background(), db, table, []string{"id"}, nil, strings.NewReader(b.String()),
+		WithLogger(discardLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsInserted != 2000 {
+		t.Errorf("got %d rows inserted, want 2000", stats.RowsInserted)
+	}
+	if n := queryInt(t, db, "SELECT amount FROM "+table+" WHERE id = 2000"); n != 19990 {
+		t.Errorf("got amount %d for the last row, want 19990", n)
+	}
+}
+
+func TestPostgresUpsertFromRows(t *testing.T) {
+	db := testDB(t)
+	columns := "id int PRIMARY KEY, amount numeric, ref uuid, doc jsonb, addr inet, data bytea"
+	testTable(t, db, "bloomdb_test_from_source", columns)
+	testTable(t, db, "bloomdb_test_from_target", columns)
+	mustExec(t, db, `INSERT INTO bloomdb_test_from_source VALUES
+		(1, 12.50, 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '{"a": 1}', '10.0.0.1', '\x0001'),
+		(2, NULL, NULL, NULL, NULL, NULL)`)
+
+	src, err := db.Query("SELECT * FROM bloomdb_test_from_source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	stats, err := UpsertFromRows(context.Background(), db, "bloomdb_test_from_target", []string{"id"}, nil, src,
+		WithLogger(discardLogger{}), WithSmallBatchThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsInserted != 2 {
+		t.Errorf("got %d rows inserted, want 2", stats.RowsInserted)
+	}
+
+	differ := queryInt(t, db, `SELECT count(*) FROM bloomdb_test_from_source s
+		FULL JOIN bloomdb_test_from_target t USING (id)
+		WHERE (s.*) IS DISTINCT FROM (t.*)`)
+	if differ != 0 {
+		t.Errorf("%d rows of the copy differ from the source", differ)
+	}
+}
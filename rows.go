@@ -0,0 +1,288 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// rowSource returns the next row to copy, with ok set to false once the input
+// is exhausted. The returned slice belongs to the caller, which may modify it.
+type rowSource func(ctx context.Context) (row []interface{}, ok bool, err error)
+
+// checkedRows fails at the first row from rows that doesn't have n values,
+// naming it by its 1-based position, rather than leaving the driver to fail
+// with a less helpful error.
+func checkedRows(rows rowSource, n int) rowSource {
+	count := 0
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := rows(ctx)
+		if !ok || err != nil {
+			return row, ok, err
+		}
+		count++
+		if len(row) != n {
+			return nil, false, fmt.Errorf("%w: row %d has %d values but %d columns expected", ErrColumnMismatch, count, len(row), n)
+		}
+		return row, true, nil
+	}
+}
+
+// loadRows wraps the rows of a load in the checks and conversions that
+// apply to every row, whichever way it's copied.
+func loadRows(rows rowSource, columns []string, opts *options, stats *UpsertStats) rowSource {
+	// Rows are numbered by their place in the input, counted here so that
+	// the rows after the filter keep the numbers they had before it.
+	var count int
+	rows = countedRows(checkedRows(rows, len(columns)), &count)
+	if opts.rowTransformer != nil {
+		rows = transformedRows(rows, len(columns), opts.rowTransformer)
+	}
+	// Filter while the values are still strings.
+	if opts.rowFilter != nil {
+		rows = filteredRows(rows, opts.rowFilter, stats)
+	}
+	if len(opts.converters) > 0 {
+		rows = convertedRows(rows, columns, &count, opts)
+	}
+	if opts.inputLine != nil {
+		rows = linedRows(rows, opts.inputLine)
+	}
+	return rows
+}
+
+// countedRows counts the rows read from rows in count.
+func countedRows(rows rowSource, count *int) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := rows(ctx)
+		if ok && err == nil {
+			*count++
+		}
+		return row, ok, err
+	}
+}
+
+// linedRows adds the line of the input a row started on to the errors about
+// it, or leaves them be if line returns 0.
+func linedRows(rows rowSource, line func() int) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := rows(ctx)
+		if err != nil {
+			if n := line(); n > 0 {
+				err = fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+		return row, ok, err
+	}
+}
+
+// transformedRows replaces each row of strings with what transform returns
+// for it, which must have n values too.
+func transformedRows(rows rowSource, n int, transform func(row []string) []string) rowSource {
+	count := 0
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := rows(ctx)
+		if !ok || err != nil {
+			return row, ok, err
+		}
+		count++
+		values, err := stringValues(nil, row, "WithRowTransformer")
+		if err != nil {
+			return nil, false, err
+		}
+		values = transform(values)
+		if len(values) != n {
+			return nil, false, fmt.Errorf("%w: row %d has %d values after WithRowTransformer but %d columns expected", ErrColumnMismatch, count, len(values), n)
+		}
+		// checkedRows made sure row has n values already.
+		for i, value := range values {
+			row[i] = value
+		}
+		return row, true, nil
+	}
+}
+
+// filteredRows skips the rows of strings keep returns false for, counting
+// them in stats.
+func filteredRows(rows rowSource, keep func(row []string) bool, stats *UpsertStats) rowSource {
+	var values []string
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		for {
+			row, ok, err := rows(ctx)
+			if !ok || err != nil {
+				return row, ok, err
+			}
+			values, err = stringValues(values, row, "WithRowFilter")
+			if err != nil {
+				return nil, false, err
+			}
+			if keep(values) {
+				return row, true, nil
+			}
+			stats.RowsFiltered++
+		}
+	}
+}
+
+// stringValues copies the values of row, which must all be strings for
+// option, into values, reusing its space.
+func stringValues(values []string, row []interface{}, option string) ([]string, error) {
+	values = values[:0]
+	for i, value := range row {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("bloomdb: %s needs rows of strings, but value %d of a row is a %T", option, i+1, value)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// checkStringOptions fails a load of values other than strings that has
+// options only taking strings.
+func (o *options) checkStringOptions() error {
+	switch {
+	case o.rowFilter != nil:
+		return errors.New("bloomdb: WithRowFilter only applies to loads of strings")
+	case o.rowTransformer != nil:
+		return errors.New("bloomdb: WithRowTransformer only applies to loads of strings")
+	}
+	return nil
+}
+
+// convertedRows runs WithConverters' funcs over the string values of their
+// columns that aren't NULL, naming a row that fails by count, the number of
+// rows read from the input so far.
+func convertedRows(rows rowSource, columns []string, count *int, opts *options) rowSource {
+	converters := make([]func(string) (interface{}, error), len(columns))
+	for i, column := range columns {
+		converters[i] = opts.converters[column]
+	}
+
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := rows(ctx)
+		if !ok || err != nil {
+			return row, ok, err
+		}
+		for i, convert := range converters {
+			s, isString := row[i].(string)
+			if convert == nil || !isString || opts.isNull(s) {
+				continue
+			}
+			row[i], err = convert(s)
+			if err != nil {
+				return nil, false, fmt.Errorf("bloomdb: converting row %d, column %q: %w", *count, columns[i], err)
+			}
+		}
+		return row, true, nil
+	}
+}
+
+func stringRows(rows chan []string) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		select {
+		case rawRow, ok := <-rows:
+			if !ok {
+				return nil, false, nil
+			}
+			row := make([]interface{}, len(rawRow))
+			for i, value := range rawRow {
+				row[i] = value
+			}
+			return row, true, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// sliceRows reads the rows of a slice, which is never modified.
+func sliceRows(rows [][]string) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		if len(rows) == 0 {
+			return nil, false, nil
+		}
+		rawRow := rows[0]
+		rows = rows[1:]
+
+		row := make([]interface{}, len(rawRow))
+		for i, value := range rawRow {
+			row[i] = value
+		}
+		return row, true, nil
+	}
+}
+
+func typedRows(rows chan []interface{}) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		select {
+		case rawRow, ok := <-rows:
+			if !ok {
+				return nil, false, nil
+			}
+			// Copy so the NULL conversion doesn't modify the caller's row.
+			row := make([]interface{}, len(rawRow))
+			copy(row, rawRow)
+			return row, true, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// mappedRows maps each item read from items to a row with mapFn.
+func mappedRows[T any](items <-chan T, mapFn func(T) []interface{}) rowSource {
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				return nil, false, nil
+			}
+			return mapFn(item), true, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// sqlRows scans each row of src into fresh values for the typed copy path.
+// Drivers such as lib/pq return numeric, uuid, jsonb and the like as []byte,
+// which the copy would send as bytea, so those become strings; only the
+// columns binary marks keep their []byte values.
+func sqlRows(src *sql.Rows, binary []bool) rowSource {
+	n := len(binary)
+	return func(ctx context.Context) ([]interface{}, bool, error) {
+		if !src.Next() {
+			return nil, false, src.Err()
+		}
+
+		row := make([]interface{}, n)
+		dest := make([]interface{}, n)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		err := src.Scan(dest...)
+		if err != nil {
+			return nil, false, err
+		}
+		for i, value := range row {
+			if b, ok := value.([]byte); ok && !binary[i] {
+				row[i] = string(b)
+			}
+		}
+		return row, true, nil
+	}
+}
+
+// binaryColumns reports which of types are binary, such as Postgres bytea
+// or MySQL blobs, whose []byte values are data rather than text.
+func binaryColumns(types []*sql.ColumnType) []bool {
+	binary := make([]bool, len(types))
+	for i, columnType := range types {
+		name := strings.ToUpper(columnType.DatabaseTypeName())
+		binary[i] = name == "BYTEA" || strings.Contains(name, "BLOB") || strings.Contains(name, "BINARY")
+	}
+	return binary
+}
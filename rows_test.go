@@ -0,0 +1,164 @@
+package bloomdb
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRows(t *testing.T) {
+	yesNo := func(s string) (interface{}, error) {
+		switch s {
+		case "Y":
+			return true, nil
+		case "N":
+			return false, nil
+		}
+		return nil, errors.New("not Y or N")
+	}
+
+	tests := []struct {
+		name     string
+		rows     [][]string
+		opts     []Option
+		want     [][]interface{}
+		filtered int64
+		wantErr  string
+	}{
+		{
+			name: "as is",
+			rows: [][]string{{"1", "Y"}, {"2", ""}},
+			want: [][]interface{}{{"1", "Y"}, {"2", ""}},
+		},
+		{
+			name:    "short row",
+			rows:    [][]string{{"1", "Y"}, {"2"}},
+			wantErr: "row 2 has 1 values but 2 columns expected",
+		},
+		{
+			name: "converted",
+			rows: [][]string{{"1", "Y"}, {"2", "N"}},
+			opts: []Option{WithConverters(map[string]func(string) (interface{}, error){"active": yesNo})},
+			want: [][]interface{}{{"1", true}, {"2", false}},
+		},
+		{
+			name: "NULLs aren't converted",
+			rows: [][]string{{"1", ""}},
+			opts: []Option{WithConverters(map[string]func(string) (interface{}, error){"active": yesNo})},
+			want: [][]interface{}{{"1", ""}},
+		},
+		{
+			name:    "conversion error",
+			rows:    [][]string{{"1", "Y"}, {"2", "maybe"}},
+			opts:    []Option{WithConverters(map[string]func(string) (interface{}, error){"active": yesNo})},
+			wantErr: `converting row 2, column "active": not Y or N`,
+		},
+		{
+			name: "transformed",
+			rows: [][]string{{"1", "y"}},
+			opts: []Option{WithRowTransformer(func(row []string) []string {
+				return []string{row[0], strings.ToUpper(row[1])}
+			})},
+			want: [][]interface{}{{"1", "Y"}},
+		},
+		{
+			name: "transformed before converting",
+			rows: [][]string{{"1", "y"}},
+			opts: []Option{
+				WithRowTransformer(func(row []string) []string { return []string{row[0], strings.ToUpper(row[1])} }),
+				WithConverters(map[string]func(string) (interface{}, error){"active": yesNo}),
+			},
+			want: [][]interface{}{{"1", true}},
+		},
+		{
+			name:    "transformer dropping a value",
+			rows:    [][]string{{"1", "Y"}},
+			opts:    []Option{WithRowTransformer(func(row []string) []string { return row[:1] })},
+			wantErr: "row 1 has 1 values after WithRowTransformer but 2 columns expected",
+		},
+		{
+			name:     "filtered",
+			rows:     [][]string{{"1", "Y"}, {"2", "N"}, {"3", "Y"}},
+			opts:     []Option{WithRowFilter(func(row []string) bool { return row[1] == "Y" })},
+			want:     [][]interface{}{{"1", "Y"}, {"3", "Y"}},
+			filtered: 1,
+		},
+		{
+			name: "filtered before converting",
+			rows: [][]string{{"1", "Y"}, {"2", "N"}},
+			opts: []Option{
+				WithRowFilter(func(row []string) bool { return row[1] == "N" }),
+				WithConverters(map[string]func(string) (interface{}, error){"active": yesNo}),
+			},
+			want:     [][]interface{}{{"2", false}},
+			filtered: 1,
+		},
+		{
+			name: "conversion error after a filtered row",
+			rows: [][]string{{"1", "Y"}, {"2", "N"}, {"3", "maybe"}},
+			opts: []Option{
+				WithRowFilter(func(row []string) bool { return row[0] != "2" }),
+				WithConverters(map[string]func(string) (interface{}, error){"active": yesNo}),
+			},
+			wantErr: `converting row 3, column "active": not Y or N`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := newOptions(test.opts)
+			stats := UpsertStats{}
+			got, err := readAll(loadRows(sliceRows(test.rows), []string{"id", "active"}, opts, &stats))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if stats.RowsFiltered != test.filtered {
+				t.Errorf("got %d rows filtered, want %d", stats.RowsFiltered, test.filtered)
+			}
+		})
+	}
+}
+
+func TestLoadRowsShortRowIsColumnMismatch(t *testing.T) {
+	_, err := readAll(loadRows(sliceRows([][]string{{"1"}}), []string{"id", "active"}, newOptions(nil), &UpsertStats{}))
+	if !errors.Is(err, ErrColumnMismatch) {
+		t.Errorf("got %v, want ErrColumnMismatch", err)
+	}
+}
+
+func TestStringOptionsNeedStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+		want string
+	}{
+		{"filter", WithRowFilter(func(row []string) bool { return true }), "WithRowFilter needs rows of strings"},
+		{"transformer", WithRowTransformer(func(row []string) []string { return row }), "WithRowTransformer needs rows of strings"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := newOptions([]Option{test.opt})
+			rows := make(chan []interface{}, 1)
+			rows <- []interface{}{1, "Y"}
+			close(rows)
+			_, err := readAll(loadRows(typedRows(rows), []string{"id", "active"}, opts, &UpsertStats{}))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want %q", err, test.want)
+			}
+			if opts.checkStringOptions() == nil {
+				t.Error("checkStringOptions accepted a load of typed rows")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package bloomdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// WithSlog logs each phase of a load to l as it ends, with the table, the
+// phase, its duration_ms and its row counts, such as rows_copied, as
+// attributes, and a failed phase's error at the error level. The progress
+// messages WithLogger would get go to l at the debug level instead.
+func WithSlog(l *slog.Logger) Option {
+	return func(o *options) {
+		o.slog = l
+		o.logger = slogLogger{l: l}
+	}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Printf(format string, v ...interface{}) {
+	s.l.Debug(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+// slogSpan logs a phase when it ends, passing its counts on to the span of
+// any Tracer too.
+type slogSpan struct {
+	ctx    context.Context
+	l      *slog.Logger
+	table  string
+	phase  string
+	start  time.Time
+	counts []slog.Attr
+	inner  PhaseSpan
+}
+
+func (s *slogSpan) SetCount(name string, n int64) {
+	s.counts = append(s.counts, slog.Int64(name, n))
+	s.inner.SetCount(name, n)
+}
+
+func (s *slogSpan) End(err error) {
+	s.inner.End(err)
+
+	attrs := append([]slog.Attr{
+		slog.String("table", s.table),
+		slog.String("phase", s.phase),
+		slog.Int64("duration_ms", time.Since(s.start).Milliseconds()),
+	}, s.counts...)
+	if err != nil {
+		s.l.LogAttrs(s.ctx, slog.LevelError, "bloomdb phase failed", append(attrs, slog.Any("error", err))...)
+		return
+	}
+	s.l.LogAttrs(s.ctx, slog.LevelInfo, "bloomdb phase done", attrs...)
+}
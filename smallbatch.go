@@ -0,0 +1,166 @@
+package bloomdb
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// maxParams is the most bind parameters Postgres takes in one statement.
+const maxParams = 65535
+
+// smallBatchAllowed reports whether a load with opts can skip the temp table
+// for a small input. Everything that needs the input in a table of its own,
+// or templates other than the dialect's, rules it out.
+func (opts *options) smallBatchAllowed() bool {
+	_, isPostgres := opts.dialect.(PostgresDialect)
+	return isPostgres && opts.smallBatchThreshold > 0 && opts.templates == nil &&
+		opts.loadMode == LoadUpsert && !opts.hasRevisions && !opts.useMerge &&
+		!opts.deleteMissing && opts.softDeleteColumn == "" && opts.watermarkColumn == "" &&
+		!opts.dedupeKeepLast && opts.rejectedRows == nil && opts.parallelism == 1 && opts.tempTable == "" &&
+		!opts.vacuumAfter && opts.validateSQL == "" && opts.lockMode == LockNone &&
+		!opts.rowCounts
+}
+
+// bufferRows reads rows until more than max have been read or the input
+// ends. If it ended, the rows read are returned with a nil rest; otherwise
+// rest replays the rows read before the rest of rows. On error it returns
+// the rows read so far. The line of each row is taken from line, if it
+// isn't nil, as the row is read, and while rest replays the rows read,
+// restLine returns the line of the row it last replayed rather than where
+// the reader has got to.
+func bufferRows(ctx context.Context, rows rowSource, max int, line func() int) (batch [][]interface{}, rest rowSource, restLine func() int, err error) {
+	var lines []int
+	for len(batch) <= max {
+		row, ok, err := rows(ctx)
+		if err != nil {
+			return batch, nil, nil, err
+		}
+		if !ok {
+			return batch, nil, nil, nil
+		}
+		batch = append(batch, row)
+		if line != nil {
+			lines = append(lines, line())
+		}
+	}
+
+	pending, pendingLines := batch, lines
+	replaying, current := false, 0
+	rest = func(ctx context.Context) ([]interface{}, bool, error) {
+		if len(pending) == 0 {
+			replaying = false
+			return rows(ctx)
+		}
+		row := pending[0]
+		pending = pending[1:]
+		if len(pendingLines) > 0 {
+			current = pendingLines[0]
+			pendingLines = pendingLines[1:]
+		}
+		replaying = true
+		return row, true, nil
+	}
+	if line != nil {
+		restLine = func() int {
+			if replaying {
+				return current
+			}
+			return line()
+		}
+	}
+	return batch, rest, restLine, nil
+}
+
+// upsertValues upserts batch straight into table with a single INSERT ...
+// VALUES, without a temp table, retrying it as opts.retry allows like the
+// upsert of a temp table.
+func upsertValues(ctx context.Context, conn DB, table string, idColumns []string, columns []string, batch [][]interface{}, opts *options, stats *UpsertStats) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	info, err := loadInfo(table, idColumns, columns, "", opts)
+	if err != nil {
+		return err
+	}
+
+	values := make([]string, len(batch))
+	args := make([]interface{}, 0, len(batch)*len(columns))
+	for i, row := range batch {
+		opts.convertNulls(row)
+		convertArrays(row)
+
+		params := make([]string, len(row))
+		for j, value := range row {
+			args = append(args, value)
+			params[j] = "$" + strconv.Itoa(len(args))
+		}
+		if info.CreatedAtColumn != "" {
+			params = append(params, "now()")
+		}
+		if info.UpdatedAtColumn != "" {
+			params = append(params, "now()")
+		}
+		values[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+	info.Values = strings.Join(values, ", ")
+
+	query, err := renderTemplate(opts.sqlTemplates(), "upsert.sql.template", info)
+	if err != nil {
+		return err
+	}
+	if stats.Statements != nil {
+		stats.Statements = &Statements{Upsert: query}
+	}
+
+	stats.RowsCopied = len(batch)
+	counter := copyCounter{ctx: ctx, table: table, opts: opts, stats: stats}
+	counter.done()
+	opts.sendEvent(ctx, EventCopyDone, table, stats)
+
+	return withRetries(ctx, table, opts, func() error {
+		return runValues(ctx, conn, table, idColumns, columns, batch, query, args, opts, stats)
+	})
+}
+
+// runValues runs the INSERT ... VALUES query of upsertValues in a
+// transaction of its own and commits it.
+func runValues(ctx context.Context, conn DB, table string, idColumns []string, columns []string, batch [][]interface{}, query string, args []interface{}, opts *options, stats *UpsertStats) error {
+	txn, err := beginTx(ctx, conn, opts)
+	if err != nil {
+		return phaseError(table, "upsert", err)
+	}
+	defer txn.Rollback()
+
+	ctx, span := opts.startPhase(ctx, table, "upsert")
+	if opts.changedRows == nil {
+		err = txn.QueryRowContext(ctx, query, args...).Scan(&stats.RowsInserted, &stats.RowsUpdated)
+	} else {
+		rows, queryErr := txn.QueryContext(ctx, query, args...)
+		err = queryErr
+		if err == nil {
+			stats.RowsInserted, stats.RowsUpdated, err = scanChanged(rows, len(opts.returnKey(idColumns)), changedRowsFunc(ctx, opts))
+			rows.Close()
+		}
+	}
+	span.End(err)
+	if err != nil {
+		err = batchDuplicates(batch, columns, opts.conflictKey(idColumns), err)
+		return phaseError(table, "upsert", err)
+	}
+	if opts.conflictAction == DoNothing {
+		stats.RowsSkipped = int64(stats.RowsCopied) - stats.RowsInserted
+		stats.RowsUpdated = 0
+	} else if opts.expectedVersionColumn != "" {
+		stats.RowsVersionConflict = int64(stats.RowsCopied) - stats.RowsInserted - stats.RowsUpdated
+	}
+	opts.sendEvent(ctx, EventUpsertDone, table, stats)
+
+	err = txn.Commit()
+	if err != nil {
+		return phaseError(table, "commit", err)
+	}
+	opts.sendEvent(ctx, EventCommitted, table, stats)
+	return nil
+}
@@ -0,0 +1,201 @@
+package bloomdb
+
+import (
+	"context"
+	"errors"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBufferRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  int
+		max   int
+		ended bool
+	}{
+		{"empty", 0, 3, true},
+		{"under max", 2, 3, true},
+		{"at max", 3, 3, true},
+		{"over max", 4, 3, false},
+		{"well over max", 10, 3, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input [][]string
+			for i := 0; i < test.rows; i++ {
+				input = append(input, []string{string(rune('a' + i))})
+			}
+
+			batch, rest, _, err := bufferRows(context.Background(), sliceRows(input), test.max, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ended := rest == nil; ended != test.ended {
+				t.Fatalf("got ended %v, want %v", ended, test.ended)
+			}
+			if rest == nil {
+				if len(batch) != test.rows {
+					t.Errorf("got %d rows, want %d", len(batch), test.rows)
+				}
+				return
+			}
+
+			// The replay has to give back every row, in order, once.
+			got, err := readAll(rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := readAll(sliceRows(input))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBufferRowsError(t *testing.T) {
+	boom := errors.New("boom")
+	n := 0
+	rows := func(ctx context.Context) ([]interface{}, bool, error) {
+		n++
+		if n == 3 {
+			return nil, false, boom
+		}
+		return []interface{}{"x"}, true, nil
+	}
+
+	batch, _, _, err := bufferRows(context.Background(), rows, 10, nil)
+	if !errors.Is(err, boom) {
+		t.Fatalf("got %v, want %v", err, boom)
+	}
+	if len(batch) != 2 {
+		t.Errorf("got %d rows read before the error, want 2", len(batch))
+	}
+}
+
+func TestBufferRowsLines(t *testing.T) {
+	// Each row takes two lines of the input, like a CSV record with a
+	// quoted newline.
+	line := 0
+	input := sliceRows([][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}})
+	rows := func(ctx context.Context) ([]interface{}, bool, error) {
+		row, ok, err := input(ctx)
+		if ok {
+			line += 2
+		}
+		return row, ok, err
+	}
+
+	_, rest, restLine, err := bufferRows(context.Background(), rows, 2, func() int { return line })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest == nil || restLine == nil {
+		t.Fatal("got no replay of an input over max")
+	}
+
+	// The first three rows were read ahead, but are replayed with the lines
+	// they were read at, and the rest with the reader's.
+	var lines []int
+	for {
+		_, ok, err := rest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		lines = append(lines, restLine())
+	}
+	if want := []int{2, 4, 6, 8, 10}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %v, want %v", lines, want)
+	}
+}
+
+func TestBatchDuplicates(t *testing.T) {
+	cardinality := &pq.Error{Code: "21000", Message: "ON CONFLICT DO UPDATE command cannot affect row a second time"}
+	columns := []string{"id", "v", "amount"}
+	tests := []struct {
+		name       string
+		batch      [][]interface{}
+		keyColumns []string
+		err        error
+		want       string
+		duplicates bool
+	}{
+		{
+			name:       "single key",
+			batch:      [][]interface{}{{"1", "a", "5"}, {"2", "a", "6"}, {"1", "b", "7"}},
+			keyColumns: []string{"id"},
+			err:        cardinality,
+			want:       "id=1 (2 rows)",
+			duplicates: true,
+		},
+		{
+			name:       "composite key",
+			batch:      [][]interface{}{{"1", "a", "5"}, {"1", "b", "6"}, {"1", "a", "7"}, {"1", "a", "8"}},
+			keyColumns: []string{"id", "v"},
+			err:        cardinality,
+			want:       "id=1, v=a (3 rows)",
+			duplicates: true,
+		},
+		{
+			name:       "NULL keys never conflict",
+			batch:      [][]interface{}{{"1", nil, "5"}, {"1", nil, "6"}},
+			keyColumns: []string{"id", "v"},
+			err:        cardinality,
+			want:       "cannot affect row a second time",
+			duplicates: true,
+		},
+		{
+			name:       "other errors",
+			batch:      [][]interface{}{{"1", "a", "5"}, {"1", "a", "6"}},
+			keyColumns: []string{"id"},
+			err:        &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"},
+			want:       "duplicate key value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := batchDuplicates(test.batch, columns, test.keyColumns, test.err)
+			if errors.Is(err, ErrDuplicateKeys) != test.duplicates {
+				t.Errorf("got %v, want ErrDuplicateKeys %v", err, test.duplicates)
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSmallBatchAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want bool
+	}{
+		{"default", nil, true},
+		{"disabled", []Option{WithSmallBatchThreshold(0)}, false},
+		{"revisions", []Option{WithRevisions()}, false},
+		{"row counts", []Option{WithRowCounts()}, false},
+		{"lock", []Option{WithLockMode(LockExclusive)}, false},
+		{"rejected rows", []Option{WithRejectedRows(make(chan RejectedRow))}, false},
+		{"named temp table", []Option{WithTempTable("claims_tmp")}, false},
+		{"mysql", []Option{WithDialect(MySQLDialect{})}, false},
+		{"analyze target", []Option{WithAnalyzeTargetAfter()}, true},
+		{"retry", []Option{WithRetry(RetryPolicy{MaxAttempts: 3})}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newOptions(test.opts).smallBatchAllowed(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package bloomdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Statements holds the SQL a load runs, in the order it runs it. Statements
+// that a load skips, such as Revisions when revisions are disabled, are
+// empty. With UpdateOnly, Upsert holds the UPDATE that's run instead.
+type Statements struct {
+	TempTable         string
+	CreateTempTable   string
+	DropTempTable     string
+	BulkLoad          string
+	Watermark         string
+	MaxWatermark      string
+	Dedupe            string
+	UniqueIndex       string
+	AnalyzeTempTable  string
+	LockTable         string
+	CountTable        string
+	Validate          string
+	Truncate          string
+	Revisions         string
+	Upsert            string
+	Unmatched         string
+	Merge             string
+	DeleteMissing     string
+	SoftDeleteMissing string
+	AnalyzeTable      string
+	VacuumTable       string
+}
+
+// BuildStatements returns the SQL that UpsertContext would run with the same
+// arguments, without touching the database. This is handy for checking the
+// output of the templates for a new table before starting a long load. Unless
+// WithTempTable is given, each call picks a new random temp table name.
+func BuildStatements(table string, idColumns []string, columns []string, opts ...Option) (Statements, error) {
+	o := newOptions(opts)
+	return buildStatements(table, idColumns, o.mapColumns(columns), o)
+}
+
+// BuildSQL returns the upsert and revision SQL that Upsert would run with
+// the same arguments, without touching the database. The revision SQL is
+// empty unless revisions are enabled. BuildStatements returns the rest of a
+// load's SQL too.
+func BuildSQL(table string, idColumn string, columns []string, opts ...Option) (string, string, error) {
+	var idColumns []string
+	if idColumn != "" {
+		idColumns = []string{idColumn}
+	}
+	st, err := BuildStatements(table, idColumns, columns, opts...)
+	if err != nil {
+		return "", "", err
+	}
+	return st.Upsert, st.Revisions, nil
+}
+
+func buildStatements(table string, idColumns []string, columns []string, opts *options) (Statements, error) {
+	dialect := opts.dialect
+
+	tempTable, err := opts.tempTableFor(table)
+	if err != nil {
+		return Statements{}, err
+	}
+
+	info, err := loadInfo(table, idColumns, columns, tempTable, opts)
+	if err != nil {
+		return Statements{}, err
+	}
+
+	templates := opts.sqlTemplates()
+	query, revisionQuery, err := buildQuery(templates, info)
+	if err != nil {
+		return Statements{}, err
+	}
+
+	mergeQuery := ""
+	if opts.useMerge && opts.loadMode == LoadUpsert && len(opts.returnColumns) == 0 && len(info.ConflictColumns) > 0 {
+		mergeQuery, err = renderTemplate(templates, "merge.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	deleteQuery := ""
+	if opts.deleteMissing {
+		deleteQuery, err = renderTemplate(templates, "deletemissing.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	validate := ""
+	if opts.validateSQL != "" {
+		validate, err = renderQuery("validate", opts.validateSQL, info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	unmatchedQuery := ""
+	if opts.unmatchedRows != nil {
+		unmatchedQuery, err = renderTemplate(templates, "unmatched.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	softDeleteQuery := ""
+	if opts.softDeleteColumn != "" {
+		softDeleteQuery, err = renderTemplate(templates, "softdelete.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	watermark, maxWatermark := "", ""
+	if opts.watermarkColumn != "" {
+		watermark, err = renderTemplate(templates, "watermark.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+		maxWatermark = "SELECT max(" + info.WatermarkColumn + ") FROM " + info.TempTable
+	}
+
+	dedupe := ""
+	if opts.dedupeKeepLast {
+		dedupe, err = renderTemplate(templates, "dedupe.sql.template", info)
+		if err != nil {
+			return Statements{}, err
+		}
+	}
+
+	truncate := ""
+	if opts.loadMode == TruncateLoad {
+		truncate = dialect.TruncateSQL(table, opts.truncateCascade)
+	}
+
+	uniqueIndex := ""
+	if !opts.skipIndex && len(info.ConflictColumns) > 0 {
+		// Naming the index after the temp table keeps loads from clashing
+		// over it.
+		indexName := opts.uniqueIndexName
+		if indexName == "" {
+			indexName = tempTable + "_key"
+		}
+		uniqueIndex = dialect.UniqueIndexSQL(tempTable, indexName, opts.conflictKey(idColumns))
+	}
+
+	countTable := ""
+	if opts.rowCounts {
+		countTable = "SELECT count(*) FROM " + quoteQualified(dialect.QuoteIdentifier, table)
+	}
+
+	analyzeTempTable := ""
+	if !opts.skipAnalyze {
+		analyzeTempTable = dialect.AnalyzeSQL(tempTable)
+	}
+
+	// VACUUM (ANALYZE) refreshes the statistics too, so it replaces the
+	// ANALYZE of table.
+	analyzeTable := ""
+	if opts.analyzeTarget {
+		analyzeTable = dialect.AnalyzeSQL(table)
+	}
+	vacuumTable := ""
+	if opts.vacuumAfter {
+		vacuumTable = "VACUUM (ANALYZE) " + quoteQualified(dialect.QuoteIdentifier, table)
+		analyzeTable = ""
+	}
+
+	createTempTable := dialect.CreateTempTableSQL(table, tempTable, opts.includes)
+	dropTempTable := dialect.DropTempTableSQL(tempTable)
+	if opts.useStaging() {
+		createTempTable = dialect.CreateStagingTableSQL(table, tempTable, opts.includes)
+		dropTempTable = dialect.DropStagingTableSQL(tempTable)
+	}
+	if opts.stagingTablespace != "" {
+		createTempTable += " TABLESPACE " + dialect.QuoteIdentifier(opts.stagingTablespace)
+	}
+
+	return Statements{
+		TempTable:         tempTable,
+		CreateTempTable:   createTempTable,
+		DropTempTable:     dropTempTable,
+		BulkLoad:          dialect.BulkLoadSQL(tempTable, columns),
+		Watermark:         watermark,
+		MaxWatermark:      maxWatermark,
+		Dedupe:            dedupe,
+		UniqueIndex:       uniqueIndex,
+		AnalyzeTempTable:  analyzeTempTable,
+		LockTable:         lockSQL(table, opts.lockMode, dialect.QuoteIdentifier),
+		CountTable:        countTable,
+		Validate:          validate,
+		Truncate:          truncate,
+		Revisions:         revisionQuery,
+		Upsert:            query,
+		Unmatched:         unmatchedQuery,
+		Merge:             mergeQuery,
+		DeleteMissing:     deleteQuery,
+		SoftDeleteMissing: softDeleteQuery,
+		AnalyzeTable:      analyzeTable,
+		VacuumTable:       vacuumTable,
+	}, nil
+}
+
+// loadInfo checks that opts can be used to load columns into table, and
+// returns the data the SQL templates are executed with for a load through
+// tempTable.
+func loadInfo(table string, idColumns []string, columns []string, tempTable string, opts *options) (upsertInfo, error) {
+	dialect := opts.dialect
+
+	if len(opts.conflictKey(idColumns)) == 0 {
+		switch {
+		case opts.hasRevisions:
+			return upsertInfo{}, errors.New("bloomdb: revisions need id columns")
+		case opts.deleteMissing || opts.softDeleteColumn != "":
+			return upsertInfo{}, errors.New("bloomdb: deleting missing rows needs id columns")
+		case opts.changedRows != nil:
+			return upsertInfo{}, errors.New("bloomdb: reporting changed rows needs id columns")
+		case opts.loadMode == UpdateOnly:
+			return upsertInfo{}, errors.New("bloomdb: updating existing rows needs id columns")
+		case opts.dedupeKeepLast:
+			return upsertInfo{}, errors.New("bloomdb: dropping duplicate rows needs id columns")
+		}
+	}
+
+	if opts.watermarkColumn != "" {
+		switch {
+		case !contains(columns, opts.watermarkColumn):
+			return upsertInfo{}, fmt.Errorf("%w: watermark column %q is not one of the loaded columns", ErrColumnMismatch, opts.watermarkColumn)
+		case opts.deleteMissing || opts.softDeleteColumn != "" || opts.loadMode == TruncateLoad:
+			return upsertInfo{}, errors.New("bloomdb: a watermark can't be combined with deleting missing rows or a truncate")
+		}
+	}
+
+	if opts.loadMode == TruncateLoad {
+		switch {
+		case opts.hasRevisions:
+			return upsertInfo{}, errors.New("bloomdb: revisions can't be kept across a truncate")
+		case opts.deleteMissing || opts.softDeleteColumn != "":
+			return upsertInfo{}, errors.New("bloomdb: deleting missing rows can't be combined with a truncate")
+		}
+	}
+
+	if opts.loadMode == UpdateOnly && opts.conflictAction == DoNothing {
+		return upsertInfo{}, errors.New("bloomdb: an update-only load can't skip existing rows")
+	}
+
+	if opts.hasRevisions && contains(columns, opts.revisionColumn) {
+		return upsertInfo{}, fmt.Errorf("bloomdb: revision column %q can't be one of the loaded columns", opts.revisionColumn)
+	}
+
+	updateColumns := columns
+	if len(opts.updateColumns) > 0 {
+		for _, column := range opts.updateColumns {
+			if !contains(columns, column) {
+				return upsertInfo{}, fmt.Errorf("%w: update column %q is not one of the loaded columns", ErrColumnMismatch, column)
+			}
+		}
+		updateColumns = opts.updateColumns
+	}
+
+	if opts.softDeleteColumn != "" {
+		if opts.deleteMissing {
+			return upsertInfo{}, errors.New("bloomdb: soft delete and delete missing can't be combined")
+		}
+		if contains(columns, opts.softDeleteColumn) {
+			return upsertInfo{}, fmt.Errorf("bloomdb: soft delete column %q can't be one of the loaded columns", opts.softDeleteColumn)
+		}
+	}
+
+	for _, column := range []string{opts.auditColumns.CreatedAtColumn, opts.auditColumns.UpdatedAtColumn} {
+		if column != "" && contains(columns, column) {
+			return upsertInfo{}, fmt.Errorf("bloomdb: audit column %q can't be one of the loaded columns", column)
+		}
+	}
+
+	if len(opts.conflictColumns) > 0 || len(opts.partitionKey) > 0 {
+		for _, column := range opts.conflictKey(idColumns) {
+			if !contains(columns, column) {
+				return upsertInfo{}, fmt.Errorf("%w: conflict column %q is not one of the loaded columns", ErrColumnMismatch, column)
+			}
+		}
+	}
+
+	if _, isMySQL := dialect.(MySQLDialect); isMySQL {
+		switch {
+		case opts.updateWhere != "":
+			return upsertInfo{}, errors.New("bloomdb: update predicates aren't supported on MySQL")
+		case opts.expectedVersionColumn != "":
+			return upsertInfo{}, errors.New("bloomdb: expected versions aren't supported on MySQL")
+		case opts.useMerge:
+			return upsertInfo{}, errors.New("bloomdb: MERGE isn't supported on MySQL")
+		case opts.dedupeKeepLast:
+			return upsertInfo{}, errors.New("bloomdb: dropping duplicate rows isn't supported on MySQL")
+		case len(opts.sessionSettings) > 0:
+			return upsertInfo{}, errors.New("bloomdb: session settings aren't supported on MySQL")
+		case len(opts.returnColumns) > 0:
+			return upsertInfo{}, errors.New("bloomdb: returning columns isn't supported on MySQL")
+		case opts.vacuumAfter:
+			return upsertInfo{}, errors.New("bloomdb: VACUUM isn't supported on MySQL")
+		case opts.lockMode != LockNone:
+			return upsertInfo{}, errors.New("bloomdb: lock modes aren't supported on MySQL")
+		case opts.stagingTablespace != "":
+			return upsertInfo{}, errors.New("bloomdb: staging tablespaces aren't supported on MySQL")
+		case len(opts.mergeStrategies) > 0:
+			return upsertInfo{}, errors.New("bloomdb: merge strategies aren't supported on MySQL")
+		case opts.loadMode == UpdateOnly && opts.changedRows != nil:
+			return upsertInfo{}, errors.New("bloomdb: reporting changed rows of an update-only load isn't supported on MySQL")
+		}
+	}
+	for name := range opts.sessionSettings {
+		if !contains(sessionSettings, name) {
+			return upsertInfo{}, fmt.Errorf("bloomdb: session setting %q can't be set by a load", name)
+		}
+	}
+
+	if opts.unmatchedRows != nil && opts.loadMode != UpdateOnly {
+		return upsertInfo{}, errors.New("bloomdb: reporting unmatched rows needs UpdateOnly")
+	}
+
+	if len(opts.returnColumns) > 0 && opts.changedRows == nil {
+		return upsertInfo{}, errors.New("bloomdb: returning columns needs WithChangedRows")
+	}
+
+	for column := range opts.mergeStrategies {
+		if !contains(updateColumns, column) {
+			return upsertInfo{}, fmt.Errorf("bloomdb: merge strategy column %q isn't an updated column", column)
+		}
+	}
+
+	if opts.useMerge && opts.updateWhere != "" {
+		return upsertInfo{}, errors.New("bloomdb: update predicates can't be combined with MERGE")
+	}
+	if opts.expectedVersionColumn != "" {
+		switch {
+		case opts.useMerge:
+			return upsertInfo{}, errors.New("bloomdb: expected versions can't be combined with MERGE")
+		case opts.hasRevisions && opts.expectedVersionColumn == opts.revisionColumn:
+			return upsertInfo{}, errors.New("bloomdb: the expected version column can't be the revision column")
+		case !contains(columns, opts.expectedVersionColumn):
+			return upsertInfo{}, fmt.Errorf("%w: expected version column %q isn't loaded", ErrColumnMismatch, opts.expectedVersionColumn)
+		}
+	}
+
+	quote := dialect.QuoteIdentifier
+	info := upsertInfo{
+		Table:             quoteQualified(quote, table),
+		TempTable:         quote(tempTable),
+		IdColumns:         quoteAll(quote, idColumns),
+		ConflictColumns:   quoteAll(quote, opts.conflictKey(idColumns)),
+		HasRevisions:      opts.hasRevisions,
+		RevisionColumn:    quote(opts.revisionColumn),
+		RevisionTimestamp: opts.revisionStrategy == RevisionTimestamp,
+		Columns:           quoteAll(quote, columns),
+		UpdateColumns:     quoteAll(quote, updateColumns),
+		DoNothing:         opts.conflictAction == DoNothing,
+		UpdateWhere:       opts.updateWhere,
+		ReturnIDs:         opts.changedRows != nil,
+		ReturnColumns:     quoteAll(quote, opts.returnColumns),
+		UpdateOnly:        opts.loadMode == UpdateOnly,
+	}
+	if opts.loadMode == TruncateLoad {
+		info.ConflictColumns = nil
+	}
+	for _, column := range updateColumns {
+		strategy := ""
+		switch opts.mergeStrategies[column] {
+		case JSONBMerge, ArrayAppend:
+			strategy = "concat"
+		case ArrayUnion:
+			strategy = "union"
+		}
+		info.UpdateStrategies = append(info.UpdateStrategies, strategy)
+	}
+	if opts.hasRevisions {
+		conflictKey := opts.conflictKey(idColumns)
+		for _, column := range updateColumns {
+			if contains(conflictKey, column) {
+				continue
+			}
+			i := indexOf(columns, column)
+			info.CompareColumns = append(info.CompareColumns, quote(column))
+			info.CompareJSON = append(info.CompareJSON, i < len(opts.json) && opts.json[i])
+		}
+	}
+	if opts.softDeleteColumn != "" {
+		info.SoftDeleteColumn = quote(opts.softDeleteColumn)
+	}
+	if opts.watermarkColumn != "" {
+		info.WatermarkColumn = quote(opts.watermarkColumn)
+	}
+	if opts.expectedVersionColumn != "" {
+		info.ExpectedVersionColumn = quote(opts.expectedVersionColumn)
+	}
+	if opts.auditColumns.CreatedAtColumn != "" {
+		info.CreatedAtColumn = quote(opts.auditColumns.CreatedAtColumn)
+	}
+	if opts.auditColumns.UpdatedAtColumn != "" {
+		info.UpdatedAtColumn = quote(opts.auditColumns.UpdatedAtColumn)
+	}
+
+	return info, nil
+}
+
+// lockSQL returns the LOCK TABLE statement for mode, or "" for LockNone.
+func lockSQL(table string, mode LockMode, quote func(string) string) string {
+	level := ""
+	switch mode {
+	case LockShareRowExclusive:
+		level = "SHARE ROW EXCLUSIVE"
+	case LockExclusive:
+		level = "EXCLUSIVE"
+	case LockAccessExclusive:
+		level = "ACCESS EXCLUSIVE"
+	default:
+		return ""
+	}
+	return "LOCK TABLE " + quoteQualified(quote, table) + " IN " + level + " MODE"
+}
@@ -0,0 +1,385 @@
+package bloomdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBuildStatements(t *testing.T) {
+	columns := []string{"id", "v", "amount"}
+	tests := []struct {
+		name      string
+		idColumns []string
+		opts      []Option
+		sql       func(Statements) string
+		want      []string
+		notWant   []string
+	}{
+		{
+			name: "composite key",
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{
+				`INSERT INTO "reporting"."Claims" ("id", "v", "amount")`,
+				`FROM "claims_tmp"`,
+				`ON CONFLICT ("id", "v") DO UPDATE SET`,
+				`"amount" = excluded."amount"`,
+				`RETURNING (xmax = 0) AS inserted`,
+			},
+		},
+		{
+			name: "composite key index",
+			sql:  func(st Statements) string { return st.UniqueIndex },
+			want: []string{`CREATE UNIQUE INDEX IF NOT EXISTS "claims_tmp_key" ON "claims_tmp"("id", "v")`},
+		},
+		{
+			name:      "append only",
+			idColumns: []string{},
+			sql:       func(st Statements) string { return st.Upsert },
+			want:      []string{`INSERT INTO "reporting"."Claims" ("id", "v", "amount")`},
+			notWant:   []string{"ON CONFLICT"},
+		},
+		{
+			name:      "append only has no index",
+			idColumns: []string{},
+			sql:       func(st Statements) string { return st.UniqueIndex },
+		},
+		{
+			name: "temp table",
+			sql:  func(st Statements) string { return st.CreateTempTable + "\n" + st.DropTempTable + "\n" + st.BulkLoad },
+			want: []string{
+				`CREATE TEMP TABLE "claims_tmp"(LIKE "reporting"."Claims")`,
+				`DROP TABLE IF EXISTS pg_temp."claims_tmp"`,
+				`COPY "claims_tmp" ("id", "v", "amount") FROM STDIN`,
+			},
+		},
+		{
+			name: "unlogged staging in a tablespace",
+			opts: []Option{WithStagingTableMode(StagingUnlogged), WithStagingTablespace("fast")},
+			sql:  func(st Statements) string { return st.CreateTempTable + "\n" + st.DropTempTable },
+			want: []string{
+				`CREATE UNLOGGED TABLE "claims_tmp"(LIKE "reporting"."Claims") TABLESPACE "fast"`,
+				`DROP TABLE IF EXISTS "claims_tmp"`,
+			},
+			notWant: []string{"pg_temp"},
+		},
+		{
+			name:    "do nothing",
+			opts:    []Option{WithConflictAction(DoNothing)},
+			sql:     func(st Statements) string { return st.Upsert },
+			want:    []string{`ON CONFLICT ("id", "v") DO NOTHING`},
+			notWant: []string{"DO UPDATE"},
+		},
+		{
+			name: "soft delete",
+			opts: []Option{WithSoftDelete("deleted_at")},
+			sql:  func(st Statements) string { return st.Upsert + "\n" + st.SoftDeleteMissing },
+			want: []string{
+				`"deleted_at" = NULL`,
+				`UPDATE "reporting"."Claims" SET "deleted_at" = now()`,
+				`WHERE "deleted_at" IS NULL AND NOT EXISTS (`,
+				`AND "claims_tmp"."v" = "reporting"."Claims"."v"`,
+			},
+		},
+		{
+			name: "delete missing",
+			opts: []Option{WithDeleteMissing()},
+			sql:  func(st Statements) string { return st.DeleteMissing },
+			want: []string{
+				`DELETE FROM "reporting"."Claims"`,
+				`WHERE "claims_tmp"."id" = "reporting"."Claims"."id"`,
+			},
+		},
+		{
+			name: "audit columns",
+			opts: []Option{WithAuditColumns(AuditColumns{CreatedAtColumn: "created_at", UpdatedAtColumn: "updated_at"})},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{
+				`("id", "v", "amount", "created_at", "updated_at")`,
+				`SELECT "id", "v", "amount", now(), now()`,
+				`"updated_at" = now()`,
+			},
+			notWant: []string{`"created_at" = `},
+		},
+		{
+			name:    "skip index and analyze",
+			opts:    []Option{WithSkipIndexCreation(), WithSkipAnalyze()},
+			sql:     func(st Statements) string { return st.UniqueIndex + st.AnalyzeTempTable },
+			notWant: []string{"INDEX", "ANALYZE"},
+		},
+		{
+			name: "unique index name",
+			opts: []Option{WithUniqueIndexName("claims_idx")},
+			sql:  func(st Statements) string { return st.UniqueIndex },
+			want: []string{`CREATE UNIQUE INDEX IF NOT EXISTS "claims_idx" ON "claims_tmp"`},
+		},
+		{
+			name: "update where",
+			opts: []Option{WithUpdateWhere("excluded.amount > 0")},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{"\tWHERE excluded.amount > 0\n\tRETURNING"},
+		},
+		{
+			name: "expected version",
+			opts: []Option{WithExpectedVersionColumn("amount")},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{`WHERE ("reporting"."Claims"."amount" IS NULL OR "reporting"."Claims"."amount" <= excluded."amount")`},
+		},
+		{
+			name: "merge",
+			opts: []Option{WithMerge()},
+			sql:  func(st Statements) string { return st.Merge },
+			want: []string{
+				`MERGE INTO "reporting"."Claims"`,
+				`USING "claims_tmp"`,
+				`WHEN MATCHED THEN UPDATE SET`,
+				`WHEN NOT MATCHED THEN INSERT ("id", "v", "amount")`,
+			},
+		},
+		{
+			name:      "merge needs a conflict key",
+			idColumns: []string{},
+			opts:      []Option{WithMerge()},
+			sql:       func(st Statements) string { return st.Merge },
+		},
+		{
+			name: "update only",
+			opts: []Option{WithLoadMode(UpdateOnly), WithUnmatchedRows(make(chan []string))},
+			sql:  func(st Statements) string { return st.Upsert + "\n" + st.Unmatched },
+			want: []string{
+				`UPDATE "reporting"."Claims" SET`,
+				`FROM "claims_tmp" AS excluded`,
+				`AND excluded."v" = "reporting"."Claims"."v"`,
+				`SELECT "claims_tmp"."id", "claims_tmp"."v"`,
+				`WHERE NOT EXISTS (`,
+			},
+			notWant: []string{"INSERT"},
+		},
+		{
+			name:    "truncate",
+			opts:    []Option{WithLoadMode(TruncateLoad)},
+			sql:     func(st Statements) string { return st.Truncate + "\n" + st.Upsert },
+			want:    []string{`TRUNCATE "reporting"."Claims"`},
+			notWant: []string{"ON CONFLICT"},
+		},
+		{
+			name: "revisions",
+			opts: []Option{WithRevisions()},
+			sql:  func(st Statements) string { return st.Revisions + "\n" + st.Upsert },
+			want: []string{
+				`SET "revision" = "reporting"."Claims"."revision" + 1`,
+				`AND ("claims_tmp"."amount" IS DISTINCT FROM "reporting"."Claims"."amount")`,
+				`COALESCE("revision", 1)`,
+				`"revision" = COALESCE(excluded."revision", "reporting"."Claims"."revision")`,
+			},
+			notWant: []string{`"claims_tmp"."id" IS DISTINCT FROM`},
+		},
+		{
+			name: "array union",
+			opts: []Option{WithMergeStrategies(map[string]MergeStrategy{"amount": ArrayUnion})},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{`unnest("reporting"."Claims"."amount" || excluded."amount") WITH ORDINALITY`},
+		},
+		{
+			name: "array append",
+			opts: []Option{WithMergeStrategies(map[string]MergeStrategy{"amount": ArrayAppend})},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{`"reporting"."Claims"."amount" || excluded."amount"`},
+		},
+		{
+			name: "changed rows",
+			opts: []Option{WithChangedRows(make(chan ChangedRow)), WithReturnColumns("amount")},
+			sql:  func(st Statements) string { return st.Upsert },
+			want: []string{`RETURNING "id", "v", "amount", (xmax = 0) AS inserted`},
+		},
+		{
+			name: "lock",
+			opts: []Option{WithLockMode(LockShareRowExclusive)},
+			sql:  func(st Statements) string { return st.LockTable },
+			want: []string{`LOCK TABLE "reporting"."Claims" IN SHARE ROW EXCLUSIVE MODE`},
+		},
+		{
+			name: "row counts",
+			opts: []Option{WithRowCounts()},
+			sql:  func(st Statements) string { return st.CountTable },
+			want: []string{`SELECT count(*) FROM "reporting"."Claims"`},
+		},
+		{
+			name: "validate",
+			opts: []Option{WithValidateSQL("SELECT count(*) FROM {{.TempTable}} WHERE amount < 0")},
+			sql:  func(st Statements) string { return st.Validate },
+			want: []string{`SELECT count(*) FROM "claims_tmp" WHERE amount < 0`},
+		},
+		{
+			name: "no target analyze by default",
+			sql:  func(st Statements) string { return st.AnalyzeTable + st.VacuumTable },
+		},
+		{
+			name: "analyze target",
+			opts: []Option{WithAnalyzeTargetAfter()},
+			sql:  func(st Statements) string { return st.AnalyzeTable },
+			want: []string{`ANALYZE "reporting"."Claims"`},
+		},
+		{
+			name: "vacuum",
+			opts: []Option{WithAnalyzeTargetAfter(), WithVacuumAfter()},
+			sql:  func(st Statements) string { return st.VacuumTable },
+			want: []string{`VACUUM (ANALYZE) "reporting"."Claims"`},
+		},
+		{
+			name: "vacuum replaces analyze",
+			opts: []Option{WithAnalyzeTargetAfter(), WithVacuumAfter()},
+			sql:  func(st Statements) string { return st.AnalyzeTable },
+		},
+		{
+			name: "mysql revisions",
+			opts: []Option{WithDialect(MySQLDialect{}), WithRevisions()},
+			sql:  func(st Statements) string { return st.CreateTempTable + "\n" + st.Revisions + "\n" + st.Upsert },
+			want: []string{
+				"CREATE TEMPORARY TABLE `claims_tmp` LIKE `reporting`.`Claims`",
+				"WHERE NOT (`claims_tmp`.`amount` <=> `reporting`.`Claims`.`amount`)",
+				"ON DUPLICATE KEY UPDATE",
+				"`revision` = COALESCE(VALUES(`revision`), `revision`)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idColumns := test.idColumns
+			if idColumns == nil {
+				idColumns = []string{"id", "v"}
+			}
+			opts := append([]Option{WithTempTable("claims_tmp")}, test.opts...)
+			st, err := BuildStatements("reporting.Claims", idColumns, columns, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sql := test.sql(st)
+			if len(test.want) == 0 && len(test.notWant) == 0 && sql != "" {
+				t.Errorf("got %q, want no SQL", sql)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(sql, want) {
+					t.Errorf("SQL is missing %q:\n%s", want, sql)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(sql, notWant) {
+					t.Errorf("SQL has %q:\n%s", notWant, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildStatementsQuotesMixedCase(t *testing.T) {
+	st, err := BuildStatements("Reporting.Claims", []string{"ClaimID"}, []string{"ClaimID", "Amount"}, WithTempTable("claims_tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"Reporting"."Claims"`, `ON CONFLICT ("ClaimID")`, `"Amount" = excluded."Amount"`} {
+		if !strings.Contains(st.Upsert, want) {
+			t.Errorf("upsert is missing %q:\n%s", want, st.Upsert)
+		}
+	}
+}
+
+func TestBuildStatementsErrors(t *testing.T) {
+	columns := []string{"id", "amount"}
+	tests := []struct {
+		name      string
+		idColumns []string
+		opts      []Option
+		want      string
+		wantErr   error
+	}{
+		{"revisions without ids", nil, []Option{WithRevisions()}, "revisions need id columns", nil},
+		{"delete missing without ids", nil, []Option{WithDeleteMissing()}, "deleting missing rows needs id columns", nil},
+		{"update only without ids", nil, []Option{WithLoadMode(UpdateOnly)}, "updating existing rows needs id columns", nil},
+		{"unknown update column", []string{"id"}, []Option{WithUpdateColumns("total")}, `update column "total"`, ErrColumnMismatch},
+		{"unknown conflict column", []string{"id"}, []Option{WithConflictColumns("total")}, `conflict column "total"`, ErrColumnMismatch},
+		{"watermark not loaded", []string{"id"}, []Option{WithWatermark("updated_at", 0)}, `watermark column "updated_at"`, ErrColumnMismatch},
+		{"revision column loaded", []string{"id"}, []Option{WithRevisions(), WithRevisionColumn("amount")}, `revision column "amount"`, nil},
+		{"soft delete and delete missing", []string{"id"}, []Option{WithSoftDelete("deleted_at"), WithDeleteMissing()}, "soft delete and delete missing", nil},
+		{"revisions and truncate", []string{"id"}, []Option{WithRevisions(), WithLoadMode(TruncateLoad)}, "revisions can't be kept across a truncate", nil},
+		{"update only doing nothing", []string{"id"}, []Option{WithLoadMode(UpdateOnly), WithConflictAction(DoNothing)}, "can't skip existing rows", nil},
+		{"unmatched without update only", []string{"id"}, []Option{WithUnmatchedRows(make(chan []string))}, "needs UpdateOnly", nil},
+		{"return columns without changed rows", []string{"id"}, []Option{WithReturnColumns("amount")}, "needs WithChangedRows", nil},
+		{"merge with update where", []string{"id"}, []Option{WithMerge(), WithUpdateWhere("true")}, "can't be combined with MERGE", nil},
+		{"expected version not loaded", []string{"id"}, []Option{WithExpectedVersionColumn("version")}, `expected version column "version"`, ErrColumnMismatch},
+		{"merge strategy not updated", []string{"id"}, []Option{WithUpdateColumns("id"), WithMergeStrategies(map[string]MergeStrategy{"amount": JSONBMerge})}, `merge strategy column "amount"`, nil},
+		{"session setting not allowed", []string{"id"}, []Option{WithSessionSettings(map[string]string{"search_path": "evil"})}, `session setting "search_path"`, nil},
+		{"schema-qualified temp table", []string{"id"}, []Option{WithTempTable("public.claims_tmp")}, "can't be schema-qualified", nil},
+		{"mysql update where", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithUpdateWhere("true")}, "update predicates aren't supported on MySQL", nil},
+		{"mysql merge", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithMerge()}, "MERGE isn't supported on MySQL", nil},
+		{"mysql vacuum", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithVacuumAfter()}, "VACUUM isn't supported on MySQL", nil},
+		{"mysql lock", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithLockMode(LockExclusive)}, "lock modes aren't supported on MySQL", nil},
+		{"mysql session settings", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithSessionSettings(map[string]string{"work_mem": "1GB"})}, "session settings aren't supported on MySQL", nil},
+		{"mysql tablespace", []string{"id"}, []Option{WithDialect(MySQLDialect{}), WithStagingTablespace("fast")}, "staging tablespaces aren't supported on MySQL", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := BuildStatements("claims", test.idColumns, columns, test.opts...)
+			if err == nil {
+				t.Fatalf("got no error, want %q", test.want)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %q, want %q", err, test.want)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want it to wrap %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionSettingsAllowed(t *testing.T) {
+	for _, name := range sessionSettings {
+		t.Run(name, func(t *testing.T) {
+			_, err := BuildStatements("claims", []string{"id"}, []string{"id", "amount"}, WithSessionSettings(map[string]string{name: "on"}))
+			if err != nil {
+				t.Errorf("got %v, want %s allowed", err, name)
+			}
+		})
+	}
+}
+
+func TestTempTableName(t *testing.T) {
+	tests := []struct {
+		table string
+		base  string
+	}{
+		{"claims", "claims_temp_"},
+		{"reporting.claims", "reporting_claims_temp_"},
+		{strings.Repeat("x", 80), strings.Repeat("x", maxIdentifierLength-len("_key")-len("_temp_12345678")) + "_temp_"},
+		{strings.Repeat("é", 40), strings.Repeat("é", 22) + "_temp_"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			name, err := tempTableName(test.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(name, test.base) || len(name) != len(test.base)+8 {
+				t.Errorf("got %q, want %q plus 8 hex digits", name, test.base)
+			}
+			if len(name+"_key") > maxIdentifierLength {
+				t.Errorf("%q's index name is %d bytes, more than %d", name, len(name+"_key"), maxIdentifierLength)
+			}
+			if !utf8.ValidString(name) {
+				t.Errorf("%q isn't valid UTF-8", name)
+			}
+			other, err := tempTableName(test.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == name {
+				t.Errorf("got %q twice, want a new name for each load", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package bloomdb
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts a span around each phase of a load, e.g. to follow loads in
+// a tracing system. The bloomotel package implements it for OpenTelemetry.
+type Tracer interface {
+	// StartPhase starts a span for phase of a load into table, as a child of
+	// any span in ctx, and returns a context carrying it. The phases are
+	// named like the Phase of an UpsertError, and all of a load's phases are
+	// children of a "load" span.
+	StartPhase(ctx context.Context, table string, phase string) (context.Context, PhaseSpan)
+}
+
+// PhaseSpan is a span started by a Tracer.
+type PhaseSpan interface {
+	// SetCount records a row count of the phase, such as "rows_copied".
+	SetCount(name string, n int64)
+	// End ends the span, marking it as failed if err isn't nil.
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetCount(name string, n int64) {}
+func (nopSpan) End(err error)                 {}
+
+// startPhase starts a span with opts.tracer, or a span that does nothing if
+// there's no tracer, logging it to opts.slog when it ends if that's set.
+func (o *options) startPhase(ctx context.Context, table string, phase string) (context.Context, PhaseSpan) {
+	span := PhaseSpan(nopSpan{})
+	if o.tracer != nil {
+		ctx, span = o.tracer.StartPhase(ctx, table, phase)
+	}
+	if o.slog != nil {
+		span = &slogSpan{ctx: ctx, l: o.slog, table: table, phase: phase, start: time.Now(), inner: span}
+	}
+	return ctx, span
+}
+
+// setCounts records the counts from stats that apply to the load on span.
+func setCounts(span PhaseSpan, stats UpsertStats) {
+	span.SetCount("rows_copied", int64(stats.RowsCopied))
+	span.SetCount("rows_inserted", stats.RowsInserted)
+	span.SetCount("rows_updated", stats.RowsUpdated)
+	if stats.RowsRejected > 0 {
+		span.SetCount("rows_rejected", stats.RowsRejected)
+	}
+	if stats.RowsSkipped > 0 {
+		span.SetCount("rows_skipped", stats.RowsSkipped)
+	}
+	if stats.RowsVersionConflict > 0 {
+		span.SetCount("rows_version_conflict", stats.RowsVersionConflict)
+	}
+}
@@ -0,0 +1,181 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UpsertTx is like UpsertContext, but runs the whole load in txn and leaves
+// committing or rolling it back to the caller, so several loads can commit
+// together.
+//
+// Everything happens in the one transaction: UpsertContext commits the copy
+// before upserting to keep the upsert's transaction short, and that can't be
+// done here. For the same reason WithParallelism and WithCopyBatchSize are
+// ignored, and WithRetry is too, since a failed statement aborts txn.
+// Neither the temp table nor table is analyzed, as ANALYZE commits the
+// transaction on MySQL and would hold a lock on table until txn ends on
+// Postgres; analyze table after committing if needed. A ConnDialect, such as
+// bloompgx's, can't be used, since its bulk load needs the connection.
+func UpsertTx(ctx context.Context, txn *sql.Tx, table string, idColumns []string, columns []string, rows chan []string, opts ...Option) (UpsertStats, error) {
+	return upsertTx(ctx, txn, table, idColumns, columns, stringRows(rows), newOptions(opts))
+}
+
+func upsertTx(ctx context.Context, txn *sql.Tx, table string, idColumns []string, columns []string, rows rowSource, opts *options) (stats UpsertStats, err error) {
+	logger := opts.logger
+	if opts.metrics != nil {
+		defer func() {
+			if err != nil {
+				opts.metrics.ObserveError(table)
+			}
+		}()
+	}
+
+	ctx, loadSpan := opts.startPhase(ctx, table, "load")
+	defer func() {
+		setCounts(loadSpan, stats)
+		loadSpan.End(err)
+	}()
+
+	// txn doesn't give access to its connection, which a ConnDialect's bulk
+	// load needs.
+	if _, isConn := opts.dialect.(ConnDialect); isConn {
+		return stats, errors.New("bloomdb: UpsertTx can't bulk load with a ConnDialect, such as bloompgx's; use UpsertContext")
+	}
+
+	err = createTable(ctx, txn, table, idColumns, opts.mapColumns(columns), opts)
+	if err != nil {
+		return stats, err
+	}
+	idColumns, columns, err = resolveColumns(ctx, txn, table, idColumns, opts.mapColumns(columns), opts)
+	if err != nil {
+		return stats, err
+	}
+	rows = loadRows(rows, columns, opts, &stats)
+
+	opts.parallelism = 1
+	st, err := buildStatements(table, idColumns, columns, opts)
+	if err != nil {
+		return stats, err
+	}
+	if opts.debugSQL {
+		stats.Statements = &st
+	}
+
+	err = checkMerge(ctx, txn, &st, opts)
+	if err != nil {
+		return stats, phaseError(table, "connect", err)
+	}
+	opts.sendEvent(ctx, EventStart, table, &stats)
+
+	startTime := time.Now()
+	logger.Printf("Starting database write...")
+
+	err = setLocals(ctx, txn, opts)
+	if err != nil {
+		return stats, phaseError(table, "session settings", err)
+	}
+	// A failed statement aborts txn on Postgres, so unlike UpsertContext,
+	// which only looks once the load has failed, this has to check first.
+	if view := viewName(ctx, txn, table, opts); view != "" {
+		return stats, phaseError(table, "create temp table", fmt.Errorf("bloomdb: %s is a view, not a table", view))
+	}
+	_, err = txn.ExecContext(ctx, st.CreateTempTable)
+	if err != nil {
+		return stats, createTempTableError(table, opts, err)
+	}
+	defer txn.ExecContext(context.Background(), st.DropTempTable)
+
+	copyCtx, span := opts.startPhase(ctx, table, "copy")
+	err = copyRowsTx(copyCtx, txn, st, table, columns, rows, opts, &stats)
+	span.SetCount("rows_copied", int64(stats.RowsCopied))
+	span.End(err)
+	if err != nil {
+		return stats, phaseError(table, "copy", err)
+	}
+	opts.sendEvent(ctx, EventCopyDone, table, &stats)
+	logger.Printf("Processed %d rows total", stats.RowsCopied)
+
+	if st.Watermark != "" {
+		err = applyWatermark(ctx, txn, st, table, opts, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if st.Dedupe != "" {
+		err = dedupe(ctx, txn, st, table, opts, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if st.UniqueIndex != "" {
+		logger.Printf("Creating table index")
+		indexCtx, span := opts.startPhase(ctx, table, "index")
+		_, err = txn.ExecContext(indexCtx, st.UniqueIndex)
+		span.End(err)
+		if err != nil {
+			err = checkDuplicates(ctx, txn, st, opts.conflictKey(idColumns), opts, err)
+			return stats, phaseError(table, "index", err)
+		}
+		opts.sendEvent(ctx, EventIndexDone, table, &stats)
+	}
+
+	err = applyUpsert(ctx, txn, st, table, idColumns, opts, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	logDone(table, startTime, opts, &stats)
+	return stats, nil
+}
+
+// copyRowsTx copies rows into the temp table through a single bulk load in
+// txn.
+func copyRowsTx(ctx context.Context, txn *sql.Tx, st Statements, table string, columns []string, rows rowSource, opts *options, stats *UpsertStats) error {
+	counter := copyCounter{ctx: ctx, table: table, opts: opts, stats: stats}
+	defer counter.done()
+
+	loader, err := opts.dialect.BulkLoad(ctx, txn, st.TempTable, columns)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		row, ok, err := rows(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		opts.convertNulls(row)
+		err = loader.WriteRow(ctx, row)
+		if err != nil {
+			opts.logger.Printf("Failed to copy row into table %s: %v", table, row)
+			return err
+		}
+		counter.count()
+
+		if opts.flushEvery > 0 && counter.stats.RowsCopied%opts.flushEvery == 0 {
+			err = loader.Close(ctx)
+			if err != nil {
+				return err
+			}
+			loader, err = opts.dialect.BulkLoad(ctx, txn, st.TempTable, columns)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return loader.Close(ctx)
+}
@@ -2,15 +2,27 @@ package bloomdb
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/lib/pq"
-	"log"
+	"io"
+	"io/fs"
+	"net"
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
+//go:embed sql/*.sql.template sql/mysql/*.sql.template
+var sqlTemplates embed.FS
+
 var fns = template.FuncMap{
 	"eq": func(x, y interface{}) bool {
 		return x == y
@@ -20,158 +32,1089 @@ var fns = template.FuncMap{
 	},
 }
 
+// UpsertStats describes the outcome of a load. When a load fails, e.g.
+// because its context was cancelled during the copy, the stats still report
+// how far it got, such as the rows copied before it stopped.
+type UpsertStats struct {
+	// RowsCopied is the number of rows read from the input and copied into the
+	// temp table.
+	RowsCopied int
+	// RowsRejected is the number of rows sent to WithRejectedRows' channel
+	// instead of being loaded. They aren't part of RowsCopied.
+	RowsRejected int64
+	// RowsFiltered is the number of input rows WithRowFilter left out. They
+	// aren't part of RowsCopied either.
+	RowsFiltered int64
+	// RowsInserted and RowsUpdated split the upserted rows into those that
+	// were new to the table and those that replaced an existing row. On
+	// Postgres each row is classified by the upsert itself, from xmax in its
+	// RETURNING clause. With DoNothing, RowsUpdated is always 0.
+	RowsInserted int64
+	RowsUpdated  int64
+	// RowsSkipped is the number of rows left out because they conflicted with
+	// an existing row, and is only set with DoNothing.
+	RowsSkipped int64
+	// RowsVersionConflict is the number of rows that weren't updated because
+	// the existing row's version had moved past the input row's, and is only
+	// set with WithExpectedVersionColumn. Rows WithUpdateWhere leaves alone
+	// are counted too.
+	RowsVersionConflict int64
+	// RevisionsUpdated is the number of rows whose revision was bumped, and is
+	// only set when revisions are enabled.
+	RevisionsUpdated int64
+	// RowsDeleted is the number of rows removed because they were missing
+	// from the input, and is only set with WithDeleteMissing.
+	RowsDeleted int64
+	// RowsSoftDeleted is the number of rows newly marked as deleted because
+	// they were missing from the input, and is only set with WithSoftDelete.
+	RowsSoftDeleted int64
+	// RowsUnmatched is the number of input rows that matched no row of the
+	// table and so were left out, and is only set with UpdateOnly. On MySQL
+	// a matched row whose values didn't change counts as unmatched, unless
+	// the connection sets CLIENT_FOUND_ROWS.
+	RowsUnmatched int64
+	// RowsBelowWatermark is the number of copied rows dropped because they
+	// weren't past WithWatermark's value. They are still part of RowsCopied.
+	RowsBelowWatermark int64
+	// RowsDuplicate is the number of copied rows dropped by
+	// WithDedupeKeepLast because a later row had the same key. They are still
+	// part of RowsCopied.
+	RowsDuplicate int64
+	// RowsBefore and RowsAfter are how many rows table had at the start and
+	// at the end of the upsert transaction, and are only set with
+	// WithRowCounts.
+	RowsBefore int64
+	RowsAfter  int64
+	// Watermark is the highest value of WithWatermark's column among the
+	// loaded rows, or the value it was given if no rows were loaded. It's
+	// whatever the driver scans the column into, e.g. a time.Time or an
+	// int64 with lib/pq.
+	Watermark interface{}
+	// Duration is the wall-clock time of the whole load.
+	Duration time.Duration
+	// Statements is the SQL the load ran, or was running when it failed, and
+	// is only set with WithDebugSQL.
+	Statements *Statements
+}
+
+// RowsDelta returns how much the load grew table by: RowsAfter less
+// RowsBefore, which is negative if it shrank. It's only meaningful with
+// WithRowCounts.
+func (s UpsertStats) RowsDelta() int64 {
+	return s.RowsAfter - s.RowsBefore
+}
+
+// rowsStaged returns how many copied rows are left in the temp table for the
+// upsert.
+func (s *UpsertStats) rowsStaged() int64 {
+	return int64(s.RowsCopied) - s.RowsBelowWatermark - s.RowsDuplicate
+}
+
+// upsertInfo is the data the SQL templates are executed with. Every name in
+// it is already quoted for the dialect.
 type upsertInfo struct {
-	Table        string
-	TempTable    string
-	IdColumn     string
-	HasRevisions bool
-	Columns      []string
+	Table     string
+	TempTable string
+	IdColumns []string
+	// ConflictColumns are the columns input rows are matched to table rows
+	// on, which are the id columns unless WithConflictColumns says otherwise.
+	ConflictColumns []string
+	HasRevisions    bool
+	// RevisionColumn is the column bumped when HasRevisions is set, and
+	// RevisionTimestamp sets it to the current time instead of adding 1.
+	RevisionColumn    string
+	RevisionTimestamp bool
+	// CompareColumns are the updated columns outside the conflict key, which
+	// the revision query compares to tell whether a row changed. CompareJSON
+	// marks the JSON ones, which Postgres can only compare as jsonb.
+	CompareColumns []string
+	CompareJSON    []bool
+	Columns        []string
+	UpdateColumns  []string
+	// UpdateStrategies says how each of UpdateColumns is updated: "" to
+	// overwrite it, "concat" to concatenate the input value onto the
+	// existing one with ||, or "union" to also drop the array elements that
+	// are already there.
+	UpdateStrategies []string
+	DoNothing        bool
+	// SoftDeleteColumn is the timestamp column marking deleted rows, or empty
+	// if rows aren't soft deleted.
+	SoftDeleteColumn string
+	// CreatedAtColumn and UpdatedAtColumn are the audit timestamp columns
+	// filled in by the upsert, or empty if not used.
+	CreatedAtColumn string
+	UpdatedAtColumn string
+	// UpdateWhere is the trusted predicate an existing row must meet to be
+	// updated, or empty to always update it.
+	UpdateWhere string
+	// ExpectedVersionColumn is the column an existing row is only updated
+	// while it holds at most the input row's value, or empty to skip the
+	// check.
+	ExpectedVersionColumn string
+	// ReturnIDs has the upsert return the key of each row it changes and
+	// whether it was inserted, instead of the counts.
+	ReturnIDs bool
+	// ReturnColumns are the columns returned after the id columns when
+	// ReturnIDs is set.
+	ReturnColumns []string
+	// WatermarkColumn is the column compared against WithWatermark's value,
+	// or empty without a watermark.
+	WatermarkColumn string
+	// Values is the VALUES list the upsert inserts instead of the temp
+	// table's rows, for small batches.
+	Values string
+	// UpdateOnly renders an UPDATE of the matching rows instead of the
+	// upsert.
+	UpdateOnly bool
 }
 
-func buildQuery(table string, tempTable string, idColumn string, columns []string, hasRevisions bool) (string, string, error) {
-	upsertBuf := &bytes.Buffer{}
-	t, err := template.New("upsert.sql.template").Funcs(fns).ParseFiles("sql/upsert.sql.template")
-	if err != nil {
-		return "", "", err
+// buildQuery renders the upsert query, or the update query with UpdateOnly,
+// and, if revisions are enabled, the revision query for a load. DoNothing
+// loads never change an existing row, so they have no revision query.
+func buildQuery(templates fs.FS, info upsertInfo) (string, string, error) {
+	name := "upsert.sql.template"
+	if info.UpdateOnly {
+		name = "update.sql.template"
 	}
-	info := upsertInfo{table, tempTable, idColumn, hasRevisions, columns}
-	err = t.Execute(upsertBuf, info)
+	query, err := renderTemplate(templates, name, info)
 	if err != nil {
 		return "", "", err
 	}
 
-	revisionBuf := &bytes.Buffer{}
-	if hasRevisions {
-		t, err = template.New("updaterevisions.sql.template").Funcs(fns).ParseFiles("sql/updaterevisions.sql.template")
-		if err != nil {
-			return "", "", err
-		}
-		err = t.Execute(revisionBuf, info)
+	revisionQuery := ""
+	if info.HasRevisions && !info.DoNothing {
+		revisionQuery, err = renderTemplate(templates, "updaterevisions.sql.template", info)
 		if err != nil {
 			return "", "", err
 		}
 	}
 
-	return upsertBuf.String(), revisionBuf.String(), nil
+	return query, revisionQuery, nil
 }
 
-func Upsert(db *sql.DB, table string, idColumn string, columns []string, rows chan []string, hasRevisions bool) error {
-	// Can't create a temporary table inside a non-temporary schema, so just
-	// replace the periods, if present, with semicolons to avoid errors.
-	tempTable := strings.Replace(table, ".", "_", -1) + "_temp"
+// renderTemplate executes one of a dialect's SQL templates.
+func renderTemplate(templates fs.FS, name string, info upsertInfo) (string, error) {
+	if _, err := fs.Stat(templates, name); err != nil {
+		return "", fmt.Errorf("bloomdb: loading SQL template %s: %w", name, err)
+	}
 
-	query, revisionQuery, err := buildQuery(table, tempTable, idColumn, columns, hasRevisions)
+	buf := &bytes.Buffer{}
+	t, err := template.New(name).Funcs(fns).ParseFS(templates, name)
 	if err != nil {
-		return err
+		return "", err
+	}
+	err = t.Execute(buf, info)
+	if err != nil {
+		return "", err
 	}
 
-	startTime := time.Now()
-	log.Println("Starting database write...")
+	return buf.String(), nil
+}
 
-	txn, err := db.Begin()
+// renderQuery executes query as a template with info, like the SQL
+// templates.
+func renderQuery(name string, query string, info upsertInfo) (string, error) {
+	t, err := template.New(name).Funcs(fns).Parse(query)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("bloomdb: parsing %s query: %w", name, err)
 	}
-
-	_, err = txn.Exec("CREATE TEMP TABLE " + tempTable + "(LIKE " + table + ")")
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, info)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Upsert copies rows into a temp table and then inserts them into table,
+// updating the existing rows whose idColumn matches. columns names the
+// values in each row; if it's empty, every writable column of table is
+// expected, in table order. With an empty idColumn every row is appended.
+// table can't be a view; a load into one fails with an error saying so.
+// It's tuned with opts, e.g. WithRevisions or WithDeleteMissing.
+//
+// The temp table is analyzed before the upsert, but table itself isn't
+// analyzed afterward unless WithAnalyzeTargetAfter or WithVacuumAfter asks
+// for it.
+func Upsert(db DB, table string, idColumn string, columns []string, rows chan []string, opts ...Option) error {
+	o := newOptions(opts)
+	var idColumns []string
+	if idColumn != "" {
+		idColumns = []string{idColumn}
+	}
+	_, err := upsert(o.ctx, db, table, idColumns, columns, stringRows(rows), o)
+	return err
+}
+
+// UpsertRows is like Upsert, but takes rows already in memory instead of a
+// channel.
+func UpsertRows(db DB, table string, idColumn string, columns []string, rows [][]string, opts ...Option) error {
+	o := newOptions(opts)
+	var idColumns []string
+	if idColumn != "" {
+		idColumns = []string{idColumn}
+	}
+	_, err := replayUpsert(o.ctx, db, table, idColumns, columns, func(attempt int) (rowSource, error) {
+		return sliceRows(rows), nil
+	}, o)
+	return err
+}
+
+// LegacyUpsert keeps the original signature of Upsert.
+//
+// Deprecated: use Upsert, passing WithRevisions() if hasRevisions is set.
+func LegacyUpsert(db DB, table string, idColumn string, columns []string, rows chan []string, hasRevisions bool) error {
+	if hasRevisions {
+		return Upsert(db, table, idColumn, columns, rows, WithRevisions())
+	}
+	return Upsert(db, table, idColumn, columns, rows)
+}
+
+// UpsertContext is like Upsert, but stops the load when ctx is cancelled. On
+// cancellation or any other error the open transaction is rolled back before
+// the error is returned, and the temp or staging table is always dropped at
+// the end. The returned stats report how many rows were copied, inserted and
+// updated, or after a failure how many rows were copied before it; the error
+// of a cancelled load wraps ctx.Err(), for errors.Is.
+//
+// idColumns lists every column of the table's unique key, so tables with a
+// composite key can be loaded too. A row with NULL in any key column never
+// conflicts with an existing row and is always inserted. WithConflictColumns
+// can match rows on a different key instead. Without any id columns every
+// row is simply appended to the table, which rules out revisions and
+// deleting missing rows. If columns is empty, the table's columns are looked
+// up with DetectColumns.
+//
+// For a partitioned Postgres table, the partition key columns are added to
+// the columns rows are matched on, since every unique index of such a table
+// includes them. They must be loaded, and the table must have a unique
+// index over the id columns and the partition key together.
+func UpsertContext(ctx context.Context, db DB, table string, idColumns []string, columns []string, rows chan []string, opts ...Option) (UpsertStats, error) {
+	return upsert(ctx, db, table, idColumns, columns, stringRows(rows), newOptions(opts))
+}
+
+// UpsertTyped is like UpsertContext, but takes rows of Go values that are
+// handed to the driver as they are, e.g. time.Time, int64 or bool, instead
+// of relying on Postgres parsing their text form. Only string values are
+// checked against the NULL sentinel; a nil value is always loaded as NULL.
+//
+// Postgres array columns take a []string, []int64, []float64 or []bool, or
+// any value wrapped with pq.Array. Elements are quoted as needed, so they
+// may contain commas and quotes.
+func UpsertTyped(ctx context.Context, db DB, table string, idColumns []string, columns []string, rows chan []interface{}, opts ...Option) (UpsertStats, error) {
+	o := newOptions(opts)
+	if err := o.checkStringOptions(); err != nil {
+		return UpsertStats{}, err
 	}
+	return upsert(ctx, db, table, idColumns, columns, typedRows(rows), o)
+}
+
+// UpsertItems is like UpsertTyped, but streams items of any type, which
+// mapFn turns into the values of columns, in order. For example:
+//
+//	type claim struct {
+//		ID     int64
+//		Amount float64
+//		Filed  time.Time
+//	}
+//
+//	stats, err := bloomdb.UpsertItems(ctx, db, "claims", []string{"id"},
+//		[]string{"id", "amount", "filed"}, claims,
+//		func(c claim) []interface{} {
+//			return []interface{}{c.ID, c.Amount, c.Filed}
+//		})
+//
+// The slice mapFn returns belongs to the load.
+func UpsertItems[T any](ctx context.Context, db DB, table string, idColumns []string, columns []string, items <-chan T, mapFn func(T) []interface{}, opts ...Option) (UpsertStats, error) {
+	o := newOptions(opts)
+	if err := o.checkStringOptions(); err != nil {
+		return UpsertStats{}, err
+	}
+	return upsert(ctx, db, table, idColumns, columns, mappedRows(items, mapFn), o)
+}
 
-	stmt, err := txn.Prepare(pq.CopyIn(tempTable, columns...))
+// UpsertFromRows is like UpsertTyped, but reads its rows from src, e.g. to
+// copy the result of a query on another table or database into table. If
+// columns is empty, the columns are named after those of src, which
+// WithColumnMapping can rename; otherwise src must have len(columns)
+// columns. Values the driver scans as []byte are loaded as text, unless src
+// reports their column as binary, such as bytea. The caller still owns src
+// and must close it.
+func UpsertFromRows(ctx context.Context, db DB, table string, idColumns []string, columns []string, src *sql.Rows, opts ...Option) (UpsertStats, error) {
+	o := newOptions(opts)
+	if err := o.checkStringOptions(); err != nil {
+		return UpsertStats{}, err
+	}
+	srcColumns, err := src.Columns()
 	if err != nil {
-		return err
+		return UpsertStats{}, err
+	}
+	if len(columns) == 0 {
+		columns = srcColumns
+	} else if len(columns) != len(srcColumns) {
+		return UpsertStats{}, fmt.Errorf("%w: %d columns given, but the source rows have %d", ErrColumnMismatch, len(columns), len(srcColumns))
+	}
+	types, err := src.ColumnTypes()
+	if err != nil {
+		return UpsertStats{}, err
 	}
 
-	rowsProcessed := 0
-	for rawRow := range rows {
-		row := make([]interface{}, len(rawRow))
-		for i, column := range rawRow {
-			if column == "" {
-				row[i] = nil
-			} else {
-				row[i] = column
+	return upsert(ctx, db, table, idColumns, columns, sqlRows(src, binaryColumns(types)), o)
+}
+
+func upsert(ctx context.Context, db DB, table string, idColumns []string, columns []string, rows rowSource, opts *options) (stats UpsertStats, err error) {
+	logger := opts.logger
+	if opts.metrics != nil {
+		defer func() {
+			if err != nil {
+				opts.metrics.ObserveError(table)
 			}
-		}
+		}()
+	}
 
-		_, err = stmt.Exec(row...)
+	ctx, loadSpan := opts.startPhase(ctx, table, "load")
+	defer func() {
+		setCounts(loadSpan, stats)
+		loadSpan.End(err)
+	}()
+	defer func() {
 		if err != nil {
-			fmt.Println("table", table, "row", row)
-			return err
+			err = viewError(ctx, db, table, opts, err)
 		}
+	}()
+
+	err = createTable(ctx, db, table, idColumns, opts.mapColumns(columns), opts)
+	if err != nil {
+		return stats, err
+	}
+	idColumns, columns, err = resolveColumns(ctx, db, table, idColumns, opts.mapColumns(columns), opts)
+	if err != nil {
+		return stats, err
+	}
+	rows = loadRows(rows, columns, opts, &stats)
 
-		rowsProcessed++
+	st, err := buildStatements(table, idColumns, columns, opts)
+	if err != nil {
+		return stats, err
+	}
+	if opts.debugSQL {
+		stats.Statements = &st
+	}
+	opts.sendEvent(ctx, EventStart, table, &stats)
 
-		if rowsProcessed%100000 == 0 {
-			log.Printf("Processed %d rows...", rowsProcessed)
+	startTime := time.Now()
+	logger.Printf("Starting database write...")
+
+	if opts.smallBatchAllowed() {
+		max := opts.smallBatchThreshold
+		if max*len(columns) > maxParams {
+			max = maxParams / len(columns)
+		}
+		batch, rest, restLine, err := bufferRows(ctx, rows, max, opts.inputLine)
+		if err != nil {
+			stats.RowsCopied = len(batch)
+			return stats, phaseError(table, "copy", err)
+		}
+		if rest == nil {
+			logger.Printf("Upserting %d rows without a temp table", len(batch))
+			err = upsertValues(ctx, db, table, idColumns, columns, batch, opts, &stats)
+			if err != nil {
+				return stats, err
+			}
+			if st.AnalyzeTable != "" {
+				err = analyzeTarget(ctx, db, table, st.AnalyzeTable, opts)
+				if err != nil {
+					return stats, err
+				}
+			}
+			err = loadDone(table, startTime, opts, &stats)
+			return stats, err
+		}
+		rows = rest
+		// The copy takes each row's line as it reads it, so the replayed
+		// rows have to report the lines they were read at.
+		if restLine != nil {
+			defer func(line func() int) { opts.inputLine = line }(opts.inputLine)
+			opts.inputLine = restLine
 		}
 	}
 
-	_, err = stmt.Exec()
+	conn, release, err := session(ctx, db)
 	if err != nil {
-		return err
+		return stats, phaseError(table, "connect", err)
 	}
+	defer release()
+	defer func() {
+		if err != nil && opts.keepStagingOnError && opts.useStaging() {
+			logger.Printf("Keeping staging table %s of the failed load", st.TempTable)
+			return
+		}
+		dropTempTable(conn, db, st)
+	}()
 
-	err = stmt.Close()
+	err = checkMerge(ctx, conn, &st, opts)
 	if err != nil {
-		return err
+		return stats, phaseError(table, "connect", err)
 	}
 
-	// Use this transaction just for the copy, and start another one afterward
-	// for better performance.
-	err = txn.Commit()
+	// Use these transactions just for the copy, and start another one
+	// afterward for better performance.
+	copyCtx, span := opts.startPhase(ctx, table, "copy")
+	if opts.parallelism > 1 {
+		err = copyRowsParallel(copyCtx, db, conn, st, table, columns, rows, opts, &stats)
+	} else {
+		err = copyRows(copyCtx, conn, st, table, columns, rows, opts, &stats)
+	}
+	stats.RowsCopied -= int(stats.RowsRejected)
+	span.SetCount("rows_copied", int64(stats.RowsCopied))
+	span.SetCount("rows_rejected", stats.RowsRejected)
+	span.End(err)
 	if err != nil {
-		return err
+		return stats, err
 	}
+	opts.sendEvent(ctx, EventCopyDone, table, &stats)
 
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
 	duration = duration / time.Second
-	log.Printf("Processed %d rows total, took %d:%02d\n", rowsProcessed,
+	logger.Printf("Processed %d rows total, took %d:%02d\n", stats.RowsCopied,
 		duration/60, duration%60)
 
-	log.Println("Creating table index")
-	_, err = db.Exec("CREATE UNIQUE INDEX ON " + tempTable + "(" + idColumn + ")")
+	if st.Watermark != "" {
+		err = applyWatermark(ctx, conn, st, table, opts, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if st.Dedupe != "" {
+		err = dedupe(ctx, conn, st, table, opts, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	// The index and ANALYZE can't overlap, even on separate connections to a
+	// staging table: CREATE INDEX takes a SHARE lock and ANALYZE a SHARE
+	// UPDATE EXCLUSIVE one, which conflict, so the second would only wait
+	// for the first. ANALYZE goes last so it's never blocked by the build.
+	if st.UniqueIndex != "" {
+		logger.Printf("Creating table index")
+		indexCtx, span := opts.startPhase(ctx, table, "index")
+		err = execTx(indexCtx, conn, st.UniqueIndex, opts)
+		span.End(err)
+		if err != nil {
+			err = checkDuplicates(ctx, conn, st, opts.conflictKey(idColumns), opts, err)
+			return stats, phaseError(table, "index", err)
+		}
+		opts.sendEvent(ctx, EventIndexDone, table, &stats)
+	}
+
+	if st.AnalyzeTempTable != "" {
+		logger.Printf("Analyzing temporary table")
+		err = analyze(ctx, conn, table, st.AnalyzeTempTable, opts)
+		if err != nil {
+			return stats, err
+		}
+		opts.sendEvent(ctx, EventAnalyzeDone, table, &stats)
+	}
+
+	err = upsertWithRetries(ctx, conn, st, table, idColumns, opts, &stats)
 	if err != nil {
+		return stats, err
+	}
+
+	if st.AnalyzeTable != "" {
+		err = analyzeTarget(ctx, db, table, st.AnalyzeTable, opts)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if st.VacuumTable != "" {
+		err = vacuum(ctx, db, table, st.VacuumTable, opts)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	err = loadDone(table, startTime, opts, &stats)
+	return stats, err
+}
+
+// loadDone records the duration of a successful load, logs its outcome and
+// calls WithOnSuccess's callback.
+func loadDone(table string, startTime time.Time, opts *options, stats *UpsertStats) error {
+	logDone(table, startTime, opts, stats)
+	if opts.onSuccess != nil {
+		if err := opts.onSuccess(*stats); err != nil {
+			return phaseError(table, "on success", err)
+		}
+	}
+	return nil
+}
+
+// logDone records the duration of a successful load and logs its outcome.
+// UpsertTx calls it in place of loadDone, as it ignores WithOnSuccess.
+func logDone(table string, startTime time.Time, opts *options, stats *UpsertStats) {
+	logger := opts.logger
+	stats.Duration = time.Since(startTime)
+	if opts.metrics != nil {
+		opts.metrics.ObserveDuration(table, stats.Duration)
+	}
+	switch {
+	case opts.loadMode == UpdateOnly:
+		logger.Printf("Done: updated %d rows, %d rows unmatched", stats.RowsUpdated, stats.RowsUnmatched)
+	case opts.conflictAction == DoNothing:
+		logger.Printf("Done: inserted %d rows, skipped %d rows", stats.RowsInserted, stats.RowsSkipped)
+	default:
+		logger.Printf("Done: inserted %d rows, updated %d rows", stats.RowsInserted, stats.RowsUpdated)
+	}
+}
+
+// vacuum runs a VACUUM statement on a connection of its own from db, and
+// outside a transaction, since VACUUM can't run inside one.
+func vacuum(ctx context.Context, db DB, table string, query string, opts *options) error {
+	opts.logger.Printf("Vacuuming updated table")
+	ctx, span := opts.startPhase(ctx, table, "vacuum")
+	_, err := db.ExecContext(ctx, query)
+	span.End(err)
+	if err != nil {
+		return phaseError(table, "vacuum", err)
+	}
+	return nil
+}
+
+// analyzeTarget runs query, analyzing table, on a connection of its own from
+// db, once the upsert has committed.
+func analyzeTarget(ctx context.Context, db DB, table string, query string, opts *options) error {
+	opts.logger.Printf("Analyzing updated table")
+	return analyze(ctx, db, table, query, opts)
+}
+
+// analyze runs an ANALYZE statement, only logging its failure with
+// WithIgnoreAnalyzeErrors.
+func analyze(ctx context.Context, conn DB, table string, query string, opts *options) error {
+	ctx, span := opts.startPhase(ctx, table, "analyze")
+	err := execTx(ctx, conn, query, opts)
+	span.End(err)
+	if err == nil {
+		return nil
+	}
+	if opts.ignoreAnalyze {
+		opts.logger.Printf("Analyze failed for table %s, continuing: %v", table, err)
+		return nil
+	}
+	return phaseError(table, "analyze", err)
+}
+
+// checkMerge clears st.Merge, so the upsert falls back to ON CONFLICT, if
+// the server is older than Postgres 15.
+func checkMerge(ctx context.Context, db querier, st *Statements, opts *options) error {
+	if st.Merge == "" {
+		return nil
+	}
+
+	var version int
+	err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version < 150000 {
+		opts.logger.Printf("Server version %d doesn't support MERGE, using ON CONFLICT", version)
+		st.Merge = ""
+	}
+	return nil
+}
+
+// beginTx starts a transaction on conn, limited by the statement timeout if
+// there is one and with WithSessionSettings' settings.
+func beginTx(ctx context.Context, conn DB, opts *options) (*sql.Tx, error) {
+	txn, err := conn.BeginTx(ctx, opts.txOptions())
+	if err != nil {
+		return nil, err
+	}
+	err = setLocals(ctx, txn, opts)
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	return txn, nil
+}
+
+// setLocals applies the statement timeout and WithSessionSettings' settings
+// to txn.
+func setLocals(ctx context.Context, txn *sql.Tx, opts *options) error {
+	if opts.statementTimeout > 0 {
+		query := opts.dialect.StatementTimeoutSQL(opts.statementTimeout)
+		if query != "" {
+			if _, err := txn.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(opts.sessionSettings) {
+		query := "SET LOCAL " + name + " = " + pq.QuoteLiteral(opts.sessionSettings[name])
+		if _, err := txn.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execTx runs query on conn, in a transaction of its own when that's needed
+// to limit it by the statement timeout or apply session settings.
+func execTx(ctx context.Context, conn DB, query string, opts *options) error {
+	if opts.statementTimeout <= 0 && len(opts.sessionSettings) == 0 {
+		_, err := conn.ExecContext(ctx, query)
 		return err
 	}
 
-	log.Println("Analyzing temporary table")
-	_, err = db.Exec("ANALYZE " + tempTable)
+	txn, err := beginTx(ctx, conn, opts)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
 
-	txn, err = db.Begin()
+	_, err = txn.ExecContext(ctx, query)
 	if err != nil {
 		return err
 	}
+	return txn.Commit()
+}
 
-	if revisionQuery != "" {
-		log.Println("Calculating revisions...")
-		res, err := txn.Exec(revisionQuery)
-		if err != nil {
+// upsertWithRetries runs the upsert transaction, retrying it as
+// opts.retry allows if it fails with a serialization failure or deadlock.
+// The temp table is left as it is, so the copy never has to be repeated.
+func upsertWithRetries(ctx context.Context, conn DB, st Statements, table string, idColumns []string, opts *options, stats *UpsertStats) error {
+	return withRetries(ctx, table, opts, func() error {
+		return runUpsert(ctx, conn, st, table, idColumns, opts, stats)
+	})
+}
+
+// withRetries runs upsert, an upsert transaction, again as opts.retry allows
+// while it fails with a serialization failure or deadlock.
+func withRetries(ctx context.Context, table string, opts *options, upsert func() error) error {
+	backoff := opts.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := upsert()
+		if err == nil || attempt >= opts.retry.MaxAttempts || !isRetryable(err) {
 			return err
 		}
-		affected, _ := res.RowsAffected()
-		log.Printf("Updated revision on %d rows", affected)
+
+		opts.logger.Printf("Upsert attempt %d failed, retrying in %v: %v", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return phaseError(table, "upsert", ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// replayUpsert runs upsert with the rows from newRows, starting the load
+// over with newRows(attempt) as opts.loadRetry allows if the connection was
+// lost.
+func replayUpsert(ctx context.Context, db DB, table string, idColumns []string, columns []string, newRows func(attempt int) (rowSource, error), opts *options) (UpsertStats, error) {
+	backoff := opts.loadRetry.Backoff
+	for attempt := 1; ; attempt++ {
+		rows, err := newRows(attempt)
+		if err != nil {
+			return UpsertStats{}, err
+		}
+		stats, err := upsert(ctx, db, table, idColumns, columns, rows, opts)
+		if err == nil || attempt >= opts.loadRetry.MaxAttempts || !isConnectionError(err) {
+			return stats, err
+		}
+
+		opts.logger.Printf("Load attempt %d into %s lost its connection, retrying in %v: %v", attempt, table, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return stats, phaseError(table, "connect", ctx.Err())
+		}
+		backoff *= 2
 	}
+}
 
-	log.Println("Performing upsert...")
-	_, err = txn.Exec(query)
+// runUpsert runs applyUpsert in a transaction of its own and commits it.
+func runUpsert(ctx context.Context, conn DB, st Statements, table string, idColumns []string, opts *options, stats *UpsertStats) error {
+	txn, err := beginTx(ctx, conn, opts)
+	if err != nil {
+		return phaseError(table, "upsert", err)
+	}
+	defer txn.Rollback()
+
+	err = applyUpsert(ctx, txn, st, table, idColumns, opts, stats)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Committing transaction...")
+	opts.logger.Printf("Committing transaction...")
+	_, span := opts.startPhase(ctx, table, "commit")
 	err = txn.Commit()
+	span.End(err)
+	if err != nil {
+		return phaseError(table, "commit", err)
+	}
+	opts.sendEvent(ctx, EventCommitted, table, stats)
+	return nil
+}
+
+// applyUpsert updates revisions, upserts the temp table into table and
+// deletes missing rows in txn. Errors are returned with the phase that
+// failed.
+func applyUpsert(ctx context.Context, txn *sql.Tx, st Statements, table string, idColumns []string, opts *options, stats *UpsertStats) error {
+	logger := opts.logger
+
+	if st.LockTable != "" {
+		logger.Printf("Locking table...")
+		spanCtx, span := opts.startPhase(ctx, table, "lock")
+		_, err := txn.ExecContext(spanCtx, st.LockTable)
+		span.End(err)
+		if err != nil {
+			return phaseError(table, "lock", err)
+		}
+	}
+
+	if st.CountTable != "" {
+		err := countRows(ctx, txn, table, st.CountTable, opts, &stats.RowsBefore)
+		if err != nil {
+			return err
+		}
+	}
+
+	if st.Validate != "" {
+		logger.Printf("Validating rows...")
+		spanCtx, span := opts.startPhase(ctx, table, "validate")
+		var violations int64
+		err := txn.QueryRowContext(spanCtx, st.Validate).Scan(&violations)
+		if err == nil && violations > 0 {
+			err = fmt.Errorf("%w: %d violations", ErrValidationFailed, violations)
+		}
+		span.End(err)
+		if err != nil {
+			return phaseError(table, "validate", err)
+		}
+	}
+
+	if st.Truncate != "" {
+		logger.Printf("Truncating table...")
+		spanCtx, span := opts.startPhase(ctx, table, "truncate")
+		_, err := txn.ExecContext(spanCtx, st.Truncate)
+		span.End(err)
+		if err != nil {
+			return phaseError(table, "truncate", err)
+		}
+	}
+
+	if st.Revisions != "" {
+		logger.Printf("Calculating revisions...")
+		spanCtx, span := opts.startPhase(ctx, table, "revisions")
+		err := updateRevisions(spanCtx, txn, st.Revisions, opts, stats)
+		span.End(err)
+		if err != nil {
+			return phaseError(table, "revisions", err)
+		}
+		span.SetCount("revisions_updated", stats.RevisionsUpdated)
+		logger.Printf("Updated revision on %d rows", stats.RevisionsUpdated)
+		opts.sendEvent(ctx, EventRevisionsDone, table, stats)
+	}
+
+	logger.Printf("Performing upsert...")
+	changed := changedRowsFunc(ctx, opts)
+
+	var err error
+	spanCtx, span := opts.startPhase(ctx, table, "upsert")
+	switch {
+	case opts.loadMode == UpdateOnly:
+		stats.RowsUpdated, err = updateRows(spanCtx, txn, st.Upsert, len(opts.returnKey(idColumns)), changed)
+		stats.RowsUnmatched = stats.rowsStaged() - stats.RowsUpdated
+		if err == nil && st.Unmatched != "" {
+			err = sendUnmatched(spanCtx, txn, st.Unmatched, len(idColumns), opts)
+		}
+	case st.Merge != "":
+		stats.RowsInserted, stats.RowsUpdated, err = countedUpsert(spanCtx, txn, opts.dialect.QuoteIdentifier,
+			table, st.TempTable, idColumns, opts.matchKey(idColumns), st.Merge, changed)
+	default:
+		stats.RowsInserted, stats.RowsUpdated, err = opts.dialect.Upsert(spanCtx, txn, table, st.TempTable, opts.returnKey(idColumns), opts.matchKey(idColumns), st.Upsert, changed)
+	}
+	if err != nil {
+		span.End(err)
+		return phaseError(table, "upsert", err)
+	}
+	if opts.conflictAction == DoNothing {
+		stats.RowsSkipped = stats.rowsStaged() - stats.RowsInserted
+		stats.RowsUpdated = 0
+	} else if opts.expectedVersionColumn != "" && opts.loadMode != UpdateOnly {
+		stats.RowsVersionConflict = stats.rowsStaged() - stats.RowsInserted - stats.RowsUpdated
+	}
+	span.SetCount("rows_inserted", stats.RowsInserted)
+	span.SetCount("rows_updated", stats.RowsUpdated)
+	span.End(nil)
+
+	if st.DeleteMissing != "" {
+		logger.Printf("Deleting missing rows...")
+		spanCtx, span := opts.startPhase(ctx, table, "delete missing")
+		res, err := txn.ExecContext(spanCtx, st.DeleteMissing)
+		if err != nil {
+			span.End(err)
+			return phaseError(table, "delete missing", err)
+		}
+		stats.RowsDeleted, _ = res.RowsAffected()
+		span.SetCount("rows_deleted", stats.RowsDeleted)
+		span.End(nil)
+		logger.Printf("Deleted %d rows", stats.RowsDeleted)
+	}
+
+	if st.SoftDeleteMissing != "" {
+		logger.Printf("Marking missing rows as deleted...")
+		spanCtx, span := opts.startPhase(ctx, table, "soft delete")
+		res, err := txn.ExecContext(spanCtx, st.SoftDeleteMissing)
+		if err != nil {
+			span.End(err)
+			return phaseError(table, "soft delete", err)
+		}
+		stats.RowsSoftDeleted, _ = res.RowsAffected()
+		span.SetCount("rows_soft_deleted", stats.RowsSoftDeleted)
+		span.End(nil)
+		logger.Printf("Marked %d rows as deleted", stats.RowsSoftDeleted)
+	}
+
+	if st.CountTable != "" {
+		err := countRows(ctx, txn, table, st.CountTable, opts, &stats.RowsAfter)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Table %s went from %d to %d rows", table, stats.RowsBefore, stats.RowsAfter)
+	}
+
+	opts.sendEvent(ctx, EventUpsertDone, table, stats)
+	return nil
+}
+
+// countRows runs the query counting the rows of table into n.
+func countRows(ctx context.Context, txn *sql.Tx, table string, query string, opts *options, n *int64) error {
+	ctx, span := opts.startPhase(ctx, table, "count")
+	err := txn.QueryRowContext(ctx, query).Scan(n)
+	span.End(err)
+	if err != nil {
+		return phaseError(table, "count", err)
+	}
+	return nil
+}
+
+// changedRowsFunc returns the func passing each changed row on to
+// WithChangedRows' channel, or nil without one. The id it's called with
+// holds the values of WithReturnColumns' columns after the id columns, which
+// it splits off into the ChangedRow's Returned.
+func changedRowsFunc(ctx context.Context, opts *options) func(id []string, inserted bool) error {
+	if opts.changedRows == nil {
+		return nil
+	}
+	return func(id []string, inserted bool) error {
+		if !inserted && opts.conflictAction == DoNothing {
+			return nil
+		}
+		row := ChangedRow{ID: id, Inserted: inserted}
+		if n := len(opts.returnColumns); n > 0 {
+			row.ID, row.Returned = id[:len(id)-n:len(id)-n], id[len(id)-n:]
+		}
+		select {
+		case opts.changedRows <- row:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// updateRows runs the update query of an UpdateOnly load, returning how many
+// rows it updated. If changed is set, the query returns the key of each
+// updated row, which is passed to it.
+func updateRows(ctx context.Context, txn *sql.Tx, query string, keyColumns int, changed func(id []string, inserted bool) error) (int64, error) {
+	if changed == nil {
+		res, err := txn.ExecContext(ctx, query)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+
+	rows, err := txn.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	_, updated, err := scanChanged(rows, keyColumns, changed)
+	return updated, err
+}
+
+// sendUnmatched runs the query finding the temp table's rows that match no
+// row of the table, sending the key of each to opts.unmatchedRows.
+func sendUnmatched(ctx context.Context, txn *sql.Tx, query string, keyColumns int, opts *options) error {
+	rows, err := txn.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		id := make([]sql.NullString, keyColumns)
+		dest := make([]interface{}, keyColumns)
+		for i := range id {
+			dest[i] = &id[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		key := make([]string, keyColumns)
+		for i, value := range id {
+			key[i] = value.String
+		}
+		select {
+		case opts.unmatchedRows <- key:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rows.Err()
+}
 
-	log.Println("Analyzing updated table")
-	_, err = db.Exec("ANALYZE " + table)
+// updateRevisions runs the revision query in txn. With
+// WithRevisionSavepoint it runs behind a savepoint, and a failure is rolled
+// back to it and logged rather than returned, leaving the revisions as they
+// were.
+func updateRevisions(ctx context.Context, txn *sql.Tx, query string, opts *options, stats *UpsertStats) error {
+	if !opts.revisionSavepoint {
+		res, err := txn.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		stats.RevisionsUpdated, _ = res.RowsAffected()
+		return nil
+	}
+
+	_, err := txn.ExecContext(ctx, "SAVEPOINT bloomdb_revisions")
 	if err != nil {
 		return err
 	}
+	res, err := txn.ExecContext(ctx, query)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		opts.logger.Printf("Revision update failed, upserting without it: %v", err)
+		_, err = txn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bloomdb_revisions")
+		return err
+	}
+	stats.RevisionsUpdated, _ = res.RowsAffected()
+	_, err = txn.ExecContext(ctx, "RELEASE SAVEPOINT bloomdb_revisions")
+	return err
+}
 
-	log.Println("Done")
-	return nil
+// isRetryable reports whether err is a Postgres serialization failure or
+// deadlock, after which the transaction can safely be run again.
+func isRetryable(err error) bool {
+	code := sqlState(err)
+	return code == "40001" || code == "40P01"
+}
+
+// isConnectionError reports whether err means the connection to the
+// database was lost or refused, rather than that a statement failed.
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr *net.OpError
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// Class 08 is a connection exception; 57P01 to 57P03 are the server
+	// shutting down or not yet accepting connections.
+	code := sqlState(err)
+	return strings.HasPrefix(code, "08") || code == "57P01" || code == "57P02" || code == "57P03"
+}
+
+// sqlState returns the SQLSTATE code of a Postgres error from lib/pq, or from
+// any driver whose errors have a SQLState method, such as pgx. It returns ""
+// for other errors.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
+
+// createTempTableError wraps err from creating the temp table, naming the
+// tablespace if the failure was WithStagingTablespace's not existing.
+func createTempTableError(table string, opts *options, err error) error {
+	if opts.stagingTablespace != "" && sqlState(err) == "42704" && strings.Contains(err.Error(), "tablespace") {
+		err = fmt.Errorf("bloomdb: staging tablespace %q doesn't exist: %w", opts.stagingTablespace, err)
+	}
+	return phaseError(table, "create temp table", err)
+}
+
+// maxIdentifierLength is the most bytes Postgres keeps of an identifier;
+// longer ones are silently truncated.
+const maxIdentifierLength = 63
+
+// tempTableFor returns the temp table to load table through: WithTempTable's,
+// or a new name from tempTableName.
+func (opts *options) tempTableFor(table string) (string, error) {
+	if opts.tempTable == "" {
+		return tempTableName(table)
+	}
+	if strings.Contains(opts.tempTable, ".") {
+		return "", fmt.Errorf("bloomdb: temp table %q can't be schema-qualified", opts.tempTable)
+	}
+	return opts.tempTable, nil
+}
+
+// tempTableName picks a temp table name for loading into table. A random
+// suffix keeps concurrent loads of the same table from colliding.
+//
+// The name is never schema-qualified: a temp table can only be created in
+// the session's own temp schema, which Postgres searches before any other
+// when looking up a table, so the quoted name alone always finds it. Only
+// the drop spells out pg_temp, so it can never hit a regular table. The name
+// is table's with the periods replaced, so "reporting.claims" loads through
+// reporting_claims_temp_<suffix>, cut short if needed so that neither it
+// nor its unique index's name gets truncated, which could lose the suffix.
+func tempTableName(table string) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	end := "_temp_" + hex.EncodeToString(suffix)
+	base := strings.Replace(table, ".", "_", -1)
+	if max := maxIdentifierLength - len("_key") - len(end); len(base) > max {
+		base = base[:max]
+		// Don't leave part of a UTF-8 sequence behind.
+		for r, size := utf8.DecodeLastRuneInString(base); r == utf8.RuneError && size == 1; r, size = utf8.DecodeLastRuneInString(base) {
+			base = base[:len(base)-1]
+		}
+	}
+	return base + end, nil
+}
+
+// dropTempTable removes the temp table once the load is over. It runs with a
+// fresh context since the load's own context may already be done. If conn
+// broke, e.g. because a cancelled query took it down, a staging table is
+// dropped over another connection from db instead; a temp table went away
+// with the session anyway.
+func dropTempTable(conn DB, db DB, st Statements) {
+	_, err := conn.ExecContext(context.Background(), st.DropTempTable)
+	if err != nil {
+		db.ExecContext(context.Background(), st.DropTempTable)
+	}
 }
@@ -0,0 +1,677 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"wrapped", phaseError("claims", "upsert", &pq.Error{Code: "40001"}), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"SQLState method", sqlStateError("40P01"), true},
+		{"plain error", errors.New("40001"), false},
+		{"nil", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryable(test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad conn", driver.ErrBadConn, true},
+		{"conn done", sql.ErrConnDone, true},
+		{"unexpected EOF", fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{"network", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, true},
+		{"connection exception", &pq.Error{Code: "08006"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"cannot connect now", phaseError("claims", "copy", &pq.Error{Code: "57P03"}), true},
+		{"query canceled", &pq.Error{Code: "57014"}, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"plain error", errors.New("boom"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isConnectionError(test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// sqlStateError is an error from a driver other than lib/pq, like pgx's.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestRowsDelta(t *testing.T) {
+	tests := []struct {
+		before, after, want int64
+	}{
+		{0, 0, 0},
+		{10, 15, 5},
+		{15, 10, -5},
+		{0, 1000, 1000},
+	}
+
+	for _, test := range tests {
+		stats := UpsertStats{RowsBefore: test.before, RowsAfter: test.after}
+		if got := stats.RowsDelta(); got != test.want {
+			t.Errorf("RowsDelta of %d to %d rows = %d, want %d", test.before, test.after, got, test.want)
+		}
+	}
+}
+
+func TestPhaseErrorUnwraps(t *testing.T) {
+	cause := &pq.Error{Code: "23505", Message: "duplicate key"}
+	err := phaseError("public.claims", "upsert", cause)
+
+	if got := err.Error(); !strings.HasPrefix(got, "bloomdb: upsert phase failed for table public.claims: ") {
+		t.Errorf("got %q", got)
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr != cause {
+		t.Errorf("errors.As didn't find the *pq.Error in %v", err)
+	}
+	var upsertErr *UpsertError
+	if !errors.As(err, &upsertErr) || upsertErr.Phase != "upsert" || upsertErr.Table != "public.claims" {
+		t.Errorf("got %+v, want the upsert phase of public.claims", upsertErr)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	stats, err := upsertFake(f, numberedRows(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsCopied != 3 || stats.RowsInserted != 3 {
+		t.Errorf("got %d rows copied and %d inserted, want 3 and 3", stats.RowsCopied, stats.RowsInserted)
+	}
+
+	// Each step runs once, in order.
+	steps := []string{"CREATE TEMP TABLE ", "COPY ", "CREATE UNIQUE INDEX ", "ANALYZE ", "WITH upserted AS", "DROP TABLE "}
+	last := -1
+	for _, step := range steps {
+		if n := f.ran(step); n != 1 {
+			t.Errorf("%q ran %d times, want once", step, n)
+		}
+		i := f.index(step)
+		if i < last {
+			t.Errorf("%q ran out of order", step)
+		}
+		last = i
+	}
+	if leftover := f.leftover(); len(leftover) > 0 {
+		t.Errorf("temp tables %v weren't dropped", leftover)
+	}
+}
+
+func TestUpsertRollsBackOnError(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		phase string
+		opts  []Option
+		// rollback is whether the failure leaves a transaction to roll
+		// back; the index is built outside one, and a failed commit ends
+		// its transaction.
+		rollback bool
+	}{
+		{"revisions", `SET "revision"`, "revisions", []Option{WithRevisions()}, true},
+		{"upsert", "WITH upserted AS", "upsert", nil, true},
+		{"delete missing", "DELETE FROM", "delete missing", []Option{WithDeleteMissing()}, true},
+		{"index", "CREATE UNIQUE INDEX", "index", nil, false},
+		{"copy", "COPY ", "copy", nil, true},
+		{"copy commit", "COMMIT", "copy", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			cause := &pq.Error{Code: "XX000", Message: "injected failure"}
+			f.fail(test.query, cause, 1)
+
+			_, err := upsertFake(f, numberedRows(3), test.opts...)
+			var upsertErr *UpsertError
+			if !errors.As(err, &upsertErr) || upsertErr.Phase != test.phase {
+				t.Fatalf("got %v, want a %s phase error", err, test.phase)
+			}
+			var pqErr *pq.Error
+			if !errors.As(err, &pqErr) || pqErr != cause {
+				t.Errorf("got %v, want it to wrap the injected error", err)
+			}
+			if leftover := f.leftover(); len(leftover) > 0 {
+				t.Errorf("temp tables %v weren't dropped", leftover)
+			}
+			if test.rollback && f.ran("ROLLBACK") == 0 {
+				t.Error("the failed transaction wasn't rolled back")
+			}
+		})
+	}
+}
+
+func TestUpsertRevisionSavepoint(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.fail(`SET "revision"`, &pq.Error{Code: "XX000", Message: "injected failure"}, 1)
+
+	stats, err := upsertFake(f, numberedRows(3), WithRevisions(), WithRevisionSavepoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsInserted != 3 {
+		t.Errorf("got %d rows inserted, want the upsert to carry on past the revisions", stats.RowsInserted)
+	}
+	if f.ran("SAVEPOINT bloomdb_revisions") != 1 || f.ran("ROLLBACK TO SAVEPOINT bloomdb_revisions") != 1 {
+		t.Errorf("ran %v, want the revisions rolled back to their savepoint", f.statements)
+	}
+	if f.ran("RELEASE SAVEPOINT") != 0 {
+		t.Error("released the savepoint of a failed revision update")
+	}
+}
+
+func TestUpsertCancelledMidCopy(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rows := make(chan []string)
+	go func() {
+		defer close(rows)
+		for _, row := range numberedRows(2000) {
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stats, err := UpsertContext(ctx, f.db, "claims", []string{"id"}, []string{"id", "amount"}, rows,
+		WithLogger(discardLogger{}), WithSmallBatchThreshold(0), WithProgressInterval(500),
+		WithProgressFunc(func(rowsProcessed int) {
+			if rowsProcessed == 500 {
+				cancel()
+			}
+		}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if stats.RowsCopied != 500 {
+		t.Errorf("got %d rows copied, want 500", stats.RowsCopied)
+	}
+	if f.ran("WITH upserted AS") > 0 {
+		t.Error("the upsert ran after the load was cancelled")
+	}
+	if leftover := f.leftover(); len(leftover) > 0 {
+		t.Errorf("temp tables %v weren't dropped", leftover)
+	}
+}
+
+func TestUpsertTempTablesDontCollide(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := upsertFake(f, numberedRows(100))
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	f.mu.Lock()
+	names := map[string]bool{}
+	for _, statement := range f.statements {
+		if strings.HasPrefix(statement, "CREATE TEMP TABLE ") {
+			names[firstIdentifier(statement)] = true
+		}
+	}
+	f.mu.Unlock()
+	if len(names) != 2 {
+		t.Errorf("got temp tables %v, want one for each load", names)
+	}
+}
+
+func TestUpsertRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		policy   RetryPolicy
+		attempts int
+		fails    bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, RetryPolicy{MaxAttempts: 3}, 2, false},
+		{"deadlock", &pq.Error{Code: "40P01"}, RetryPolicy{MaxAttempts: 3}, 2, false},
+		{"no policy", &pq.Error{Code: "40001"}, RetryPolicy{}, 1, true},
+		{"not retryable", &pq.Error{Code: "23505"}, RetryPolicy{MaxAttempts: 3}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			f.fail("WITH upserted AS", test.err, 1)
+
+			stats, err := upsertFake(f, numberedRows(3), WithRetry(test.policy))
+			if (err != nil) != test.fails {
+				t.Fatalf("got %v, want failure %v", err, test.fails)
+			}
+			if n := f.ran("WITH upserted AS"); n != test.attempts {
+				t.Errorf("upsert ran %d times, want %d", n, test.attempts)
+			}
+			// The copy is never repeated.
+			if n := f.ran("COPY "); n != 1 {
+				t.Errorf("copy ran %d times, want once", n)
+			}
+			if !test.fails && stats.RowsInserted != 3 {
+				t.Errorf("got %d rows inserted, want 3", stats.RowsInserted)
+			}
+		})
+	}
+}
+
+func TestUpsertRowsLoadRetries(t *testing.T) {
+	lost := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		name     string
+		query    string
+		opts     []Option
+		attempts int
+	}{
+		{"lost mid-copy", "COPY ", []Option{WithSmallBatchThreshold(0)}, 2},
+		{"lost mid-upsert", "WITH upserted AS", []Option{WithSmallBatchThreshold(0)}, 2},
+		{"small batch", "VALUES", nil, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			f.fail(test.query, lost, 1)
+
+			opts := append([]Option{WithLogger(discardLogger{}), WithLoadRetries(RetryPolicy{MaxAttempts: 3})}, test.opts...)
+			err := UpsertRows(f.db, "claims", "id", []string{"id", "amount"}, numberedRows(3), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := f.ran("SELECT column_name"); n != test.attempts {
+				t.Errorf("the load ran %d times, want %d", n, test.attempts)
+			}
+			if leftover := f.leftover(); len(leftover) > 0 {
+				t.Errorf("temp tables %v weren't dropped", leftover)
+			}
+		})
+	}
+}
+
+func TestUpsertRowsLoadRetriesOnlyConnectionErrors(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.fail("COPY ", &pq.Error{Code: "22P02", Message: "invalid input syntax"}, 1)
+
+	err := UpsertRows(f.db, "claims", "id", []string{"id", "amount"}, numberedRows(3),
+		WithLogger(discardLogger{}), WithSmallBatchThreshold(0), WithLoadRetries(RetryPolicy{MaxAttempts: 3}))
+	if err == nil {
+		t.Fatal("got no error, want the copy's")
+	}
+	if n := f.ran("SELECT column_name"); n != 1 {
+		t.Errorf("the load ran %d times, want once", n)
+	}
+}
+
+func TestUpsertAnalyzeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		fails bool
+	}{
+		{"returned", nil, true},
+		{"ignored", []Option{WithIgnoreAnalyzeErrors()}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			f.fail("ANALYZE ", &pq.Error{Code: "57014", Message: "canceling statement"}, 1)
+
+			_, err := upsertFake(f, numberedRows(3), test.opts...)
+			if !test.fails {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var upsertErr *UpsertError
+			if !errors.As(err, &upsertErr) || upsertErr.Phase != "analyze" {
+				t.Errorf("got %v, want an analyze phase error", err)
+			}
+		})
+	}
+}
+
+func TestUpsertSmallBatchThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      int
+		threshold int
+		tempTable bool
+	}{
+		{"under", 3, 5, false},
+		{"at", 5, 5, false},
+		{"over", 6, 5, true},
+		{"disabled", 3, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			stats, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"},
+				rowsOf(numberedRows(test.rows)...), WithLogger(discardLogger{}), WithSmallBatchThreshold(test.threshold))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.ran("CREATE TEMP TABLE ") > 0; got != test.tempTable {
+				t.Errorf("got temp table %v, want %v", got, test.tempTable)
+			}
+			if stats.RowsCopied != test.rows || stats.RowsInserted != int64(test.rows) {
+				t.Errorf("got %d rows copied and %d inserted, want %d", stats.RowsCopied, stats.RowsInserted, test.rows)
+			}
+		})
+	}
+}
+
+func TestUpsertSmallBatchRetries(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.fail("VALUES", &pq.Error{Code: "40001"}, 1)
+
+	stats, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"},
+		rowsOf(numberedRows(3)...), WithLogger(discardLogger{}), WithRetry(RetryPolicy{MaxAttempts: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.ran("WITH upserted AS"); n != 2 {
+		t.Errorf("upsert ran %d times, want 2", n)
+	}
+	if stats.RowsInserted != 3 {
+		t.Errorf("got %d rows inserted, want 3", stats.RowsInserted)
+	}
+}
+
+func TestUpsertSmallBatchDuplicateKeys(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.fail("VALUES", &pq.Error{Code: "21000", Message: "ON CONFLICT DO UPDATE command cannot affect row a second time"}, 1)
+
+	_, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"},
+		rowsOf([]string{"1", "a"}, []string{"2", "b"}, []string{"1", "c"}), WithLogger(discardLogger{}))
+	if !errors.Is(err, ErrDuplicateKeys) {
+		t.Fatalf("got %v, want ErrDuplicateKeys", err)
+	}
+	if !strings.Contains(err.Error(), "id=1 (2 rows)") {
+		t.Errorf("got %q, want it to list id=1", err)
+	}
+}
+
+func TestUpsertRejectedRows(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.badValue = "oops"
+	rejected := make(chan RejectedRow, 10)
+
+	stats, err := upsertFake(f, [][]string{{"1", "10"}, {"2", "oops"}, {"3", "30"}}, WithRejectedRows(rejected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(rejected)
+
+	var got []RejectedRow
+	for row := range rejected {
+		got = append(got, row)
+	}
+	if len(got) != 1 || got[0].Row[1] != "oops" || got[0].Err == nil {
+		t.Fatalf("got rejected rows %v, want the oops row", got)
+	}
+	if stats.RowsRejected != 1 || stats.RowsCopied != 2 {
+		t.Errorf("got %d rows rejected and %d copied, want 1 and 2", stats.RowsRejected, stats.RowsCopied)
+	}
+	// Only the rows of the failed batch, up to the bad one, are replayed;
+	// the copy then carries on as usual.
+	if n := f.ran("SAVEPOINT bloomdb_row"); n != 2 {
+		t.Errorf("replayed %d rows behind savepoints, want 2", n)
+	}
+}
+
+func TestUpsertParallel(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	stats, err := upsertFake(f, numberedRows(1000), WithParallelism(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsCopied != 1000 || stats.RowsInserted != 1000 {
+		t.Errorf("got %d rows copied and %d inserted, want 1000", stats.RowsCopied, stats.RowsInserted)
+	}
+	if f.ran("CREATE UNLOGGED TABLE ") != 1 {
+		t.Error("the parallel load didn't use a staging table")
+	}
+	if n := f.ran("COPY "); n != 4 {
+		t.Errorf("got %d copies, want one for each of 4 workers", n)
+	}
+	if leftover := f.leftover(); len(leftover) > 0 {
+		t.Errorf("staging tables %v weren't dropped", leftover)
+	}
+}
+
+func TestUpsertRowCounts(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.counts = []int64{10, 12}
+
+	stats, err := upsertFake(f, numberedRows(3), WithRowCounts(), WithDeleteMissing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsBefore != 10 || stats.RowsAfter != 12 || stats.RowsDelta() != 2 {
+		t.Errorf("got %d rows before and %d after, delta %d, want 10, 12 and 2", stats.RowsBefore, stats.RowsAfter, stats.RowsDelta())
+	}
+	if f.index("SELECT count(*)") > f.index("WITH upserted AS") {
+		t.Error("the table was first counted after the upsert")
+	}
+}
+
+func TestUpsertValidate(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.counts = []int64{2}
+
+	_, err := upsertFake(f, numberedRows(3), WithValidateSQL("SELECT count(*) FROM {{.TempTable}} WHERE amount IS NULL"))
+	if !errors.Is(err, ErrValidationFailed) || !strings.Contains(err.Error(), "2 violations") {
+		t.Fatalf("got %v, want ErrValidationFailed with 2 violations", err)
+	}
+	if f.ran("WITH upserted AS") > 0 {
+		t.Error("the upsert ran despite the violations")
+	}
+}
+
+func TestUpsertView(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.tableType = "VIEW"
+	f.fail("CREATE TEMP TABLE", &pq.Error{Code: "42809", Message: `"claims" is not a table`}, 1)
+
+	_, err := upsertFake(f, numberedRows(3))
+	if err == nil || !strings.Contains(err.Error(), "public.claims is a view, not a table") {
+		t.Errorf("got %v, want it to say claims is a view", err)
+	}
+}
+
+func TestUpsertColumnMismatch(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	_, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "total"},
+		rowsOf(), WithLogger(discardLogger{}))
+	if !errors.Is(err, ErrColumnMismatch) {
+		t.Errorf("got %v, want ErrColumnMismatch", err)
+	}
+}
+
+func TestUpsertNoColumns(t *testing.T) {
+	// A missing table has no columns to look up.
+	f := newFakeDB(t)
+	_, err := UpsertContext(context.Background(), f.db, "claims", []string{"id"}, nil,
+		rowsOf(), WithLogger(discardLogger{}))
+	if !errors.Is(err, ErrNoColumns) {
+		t.Errorf("got %v, want ErrNoColumns", err)
+	}
+	if errors.Is(err, ErrColumnMismatch) {
+		t.Errorf("got %v, which isn't a column mismatch", err)
+	}
+}
+
+func TestUpsertTxRejectsConnDialect(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	txn, err := f.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+
+	_, err = UpsertTx(context.Background(), txn, "claims", []string{"id"}, []string{"id", "amount"},
+		rowsOf(), WithLogger(discardLogger{}), WithDialect(fakeConnDialect{}))
+	if err == nil || !strings.Contains(err.Error(), "use UpsertContext") {
+		t.Errorf("got %v, want UpsertTx to refuse a ConnDialect", err)
+	}
+}
+
+// fakeConnDialect is a ConnDialect, like bloompgx's.
+type fakeConnDialect struct {
+	PostgresDialect
+}
+
+func (fakeConnDialect) BulkLoadConn(ctx context.Context, conn *sql.Conn, txn *sql.Tx, tempTable string, columns []string) (BulkLoader, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestUpsertFromRows(t *testing.T) {
+	f := newFakeDB(t, "id", "amount", "doc", "data")
+	// lib/pq scans numeric and jsonb as []byte, like bytea.
+	f.source = &fakeRows{
+		columns: []string{"id", "amount", "doc", "data"},
+		types:   []string{"INT4", "NUMERIC", "JSONB", "BYTEA"},
+		values:  [][]driver.Value{{int64(1), []byte("12.50"), []byte(`{"a": 1}`), []byte{0, 1}}},
+	}
+	src, err := f.db.Query("SELECT * FROM source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	stats, err := UpsertFromRows(context.Background(), f.db, "claims", []string{"id"}, nil, src,
+		WithLogger(discardLogger{}), WithSmallBatchThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RowsCopied != 1 {
+		t.Errorf("got %d rows copied, want 1", stats.RowsCopied)
+	}
+	want := [][]driver.Value{{int64(1), "12.50", `{"a": 1}`, []byte{0, 1}}}
+	if !reflect.DeepEqual(f.copied, want) {
+		t.Errorf("copied %#v, want %#v", f.copied, want)
+	}
+}
+
+func TestUpsertFromRowsColumnMismatch(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.source = &fakeRows{columns: []string{"id"}}
+	src, err := f.db.Query("SELECT * FROM source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	_, err = UpsertFromRows(context.Background(), f.db, "claims", []string{"id"}, []string{"id", "amount"}, src,
+		WithLogger(discardLogger{}))
+	if !errors.Is(err, ErrColumnMismatch) {
+		t.Errorf("got %v, want ErrColumnMismatch", err)
+	}
+}
+
+func TestUpsertTxSessionSettingsError(t *testing.T) {
+	f := newFakeDB(t, "id", "amount")
+	f.fail("SET LOCAL work_mem", &pq.Error{Code: "22023", Message: `invalid value for parameter "work_mem"`}, 1)
+	txn, err := f.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+
+	_, err = UpsertTx(context.Background(), txn, "claims", []string{"id"}, []string{"id", "amount"},
+		rowsOf(numberedRows(3)...), WithLogger(discardLogger{}), WithSessionSettings(map[string]string{"work_mem": "lots"}))
+	var upsertErr *UpsertError
+	if !errors.As(err, &upsertErr) || upsertErr.Phase != "session settings" {
+		t.Errorf("got %v, want a session settings phase error", err)
+	}
+}
+
+// lineLogger keeps the lines the load logs.
+type lineLogger struct {
+	lines []string
+}
+
+func (l *lineLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestUpsertTxDoneLog(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"upsert", nil, "Done: inserted 3 rows, updated 0 rows"},
+		{"update only", []Option{WithLoadMode(UpdateOnly)}, "Done: updated 0 rows, 3 rows unmatched"},
+		{"do nothing", []Option{WithConflictAction(DoNothing)}, "Done: inserted 3 rows, skipped 0 rows"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeDB(t, "id", "amount")
+			txn, err := f.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer txn.Rollback()
+
+			logger := &lineLogger{}
+			opts := append([]Option{WithLogger(logger)}, test.opts...)
+			_, err = UpsertTx(context.Background(), txn, "claims", []string{"id"}, []string{"id", "amount"}, rowsOf(numberedRows(3)...), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logger.lines) == 0 || logger.lines[len(logger.lines)-1] != test.want {
+				t.Errorf("logged %q, want it to end with %q", logger.lines, test.want)
+			}
+		})
+	}
+}
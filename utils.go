@@ -2,10 +2,49 @@ package bloomdb
 
 import (
 	"github.com/go-contrib/uuid"
+	"sort"
 	"strings"
 )
 
 func MakeKey(values ...string) string {
 	key := "[" + strings.Join(values, "][") + "]"
 	return uuid.NewV3(uuid.NamespaceOID, key).String()
-}
\ No newline at end of file
+}
+
+func contains(values []string, value string) bool {
+	return indexOf(values, value) >= 0
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortedKeys returns the keys of m in order, so statements built from a map
+// come out the same every time.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteQualified quotes each dot-separated part of a possibly
+// schema-qualified name.
+func quoteQualified(quote func(string) string, name string) string {
+	return strings.Join(quoteAll(quote, strings.Split(name, ".")), ".")
+}
+
+func quoteAll(quote func(string) string, names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quote(name)
+	}
+	return quoted
+}
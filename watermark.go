@@ -0,0 +1,48 @@
+package bloomdb
+
+import (
+	"context"
+	"database/sql"
+)
+
+// execQuerier is what applyWatermark needs of a connection or transaction.
+type execQuerier interface {
+	querier
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// applyWatermark deletes the rows of the temp table that aren't past the
+// watermark and records the new watermark in stats.
+func applyWatermark(ctx context.Context, conn execQuerier, st Statements, table string, opts *options, stats *UpsertStats) error {
+	ctx, span := opts.startPhase(ctx, table, "watermark")
+	err := filterWatermark(ctx, conn, st, opts, stats)
+	span.SetCount("rows_below_watermark", stats.RowsBelowWatermark)
+	span.End(err)
+	if err != nil {
+		return phaseError(table, "watermark", err)
+	}
+	opts.logger.Printf("Skipped %d rows at or below the watermark", stats.RowsBelowWatermark)
+	return nil
+}
+
+func filterWatermark(ctx context.Context, conn execQuerier, st Statements, opts *options, stats *UpsertStats) error {
+	stats.Watermark = opts.watermarkValue
+	if opts.watermarkValue != nil {
+		res, err := conn.ExecContext(ctx, st.Watermark, opts.watermarkValue)
+		if err != nil {
+			return err
+		}
+		stats.RowsBelowWatermark, _ = res.RowsAffected()
+	}
+
+	var max interface{}
+	err := conn.QueryRowContext(ctx, st.MaxWatermark).Scan(&max)
+	if err != nil {
+		return err
+	}
+	// Without any rows left, the watermark stays where it was.
+	if max != nil {
+		stats.Watermark = max
+	}
+	return nil
+}